@@ -0,0 +1,82 @@
+package mq
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Action tells a consumer what to do with a message once handled.
+type Action int
+
+const (
+	// Acked removes the message, a handler returning nil means Acked.
+	Acked Action = iota
+	// Requeued makes the message available again right away.
+	Requeued
+	// Rejected sends the message down the dead-letter path, a dead-letter
+	// exchange on rabbit, straight to the dead letter queue on SQS when the
+	// consumer has one, the redrive policy otherwise, which redelivers the
+	// message until the queue's maxReceiveCount.
+	Rejected
+	// Deferred makes the message available again after a delay, on rabbit
+	// through the retry wait queues when set up, a per message ttl in the
+	// queue's .deferred one otherwise.
+	Deferred
+	// Dropped removes the message without dead-lettering it.
+	Dropped
+)
+
+func (a Action) String() string {
+	switch a {
+	case Acked:
+		return "ack"
+	case Requeued:
+		return "requeue"
+	case Rejected:
+		return "reject"
+	case Deferred:
+		return "defer"
+	case Dropped:
+		return "drop"
+	default:
+		return fmt.Sprintf("action(%d)", int(a))
+	}
+}
+
+// Disposition is returned as an error by handlers which need more than the
+// default treatment of a failure.
+type Disposition struct {
+	Action Action
+	Delay  time.Duration
+	Err    error
+}
+
+func (d *Disposition) Error() string {
+	if d.Err == nil {
+		return d.Action.String()
+	}
+	return fmt.Sprintf("%s: %s", d.Action, d.Err)
+}
+
+func (d *Disposition) Unwrap() error { return d.Err }
+
+func Requeue(err error) error { return &Disposition{Action: Requeued, Err: err} }
+func Reject(err error) error  { return &Disposition{Action: Rejected, Err: err} }
+func Drop(err error) error    { return &Disposition{Action: Dropped, Err: err} }
+func RetryAfter(delay time.Duration, err error) error {
+	return &Disposition{Action: Deferred, Delay: delay, Err: err}
+}
+
+// DispositionOf resolves what a handler returned, nil is Acked, a plain
+// error falls back to fallback.
+func DispositionOf(err error, fallback Action) Disposition {
+	if err == nil {
+		return Disposition{Action: Acked}
+	}
+	var d *Disposition
+	if errors.As(err, &d) {
+		return *d
+	}
+	return Disposition{Action: fallback, Err: err}
+}
@@ -0,0 +1,323 @@
+package memory
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/s4mli/bolsa/mq"
+)
+
+const (
+	Direct = "direct"
+	Topic  = "topic"
+	Fanout = "fanout"
+)
+
+var (
+	ErrUnroutable   = fmt.Errorf("unroutable")
+	ErrStaleReceipt = fmt.Errorf("stale receipt")
+)
+
+// QueueOptions covers both flavours, a VisibilityTimeout makes a queue
+// behave like SQS (unsettled messages come back once it elapses), without
+// one messages stay in flight until settled like on rabbit. A message
+// received more than MaxReceiveCount times, expired by MessageTTL or
+// rejected goes to DeadLetterExchange when there is one.
+type QueueOptions struct {
+	VisibilityTimeout    time.Duration
+	MessageTTL           time.Duration
+	MaxReceiveCount      int
+	DeadLetterExchange   string
+	DeadLetterRoutingKey string
+}
+
+type binding struct{ queue, key string }
+
+type exchange struct {
+	kind     string
+	bindings []binding
+}
+
+type envelope struct {
+	message      mq.Message
+	enqueuedAt   time.Time
+	visibleAt    time.Time
+	receiveCount int
+	receipt      uint64
+}
+
+type queue struct {
+	name     string
+	options  QueueOptions
+	ready    []*envelope
+	inFlight map[uint64]*envelope
+}
+
+// Broker routes, queues and settles messages in process, it is safe for
+// concurrent use and driven by an injectable clock so tests can move time.
+type Broker struct {
+	mu        sync.Mutex
+	now       func() time.Time
+	receipt   uint64
+	exchanges map[string]*exchange
+	queues    map[string]*queue
+}
+
+func (b *Broker) SetClock(now func() time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.now = now
+}
+
+func (b *Broker) DeclareExchange(name, kind string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch kind {
+	case Direct, Topic, Fanout:
+	default:
+		return fmt.Errorf("exchange(%s): unknown kind %s", name, kind)
+	}
+	if e, ok := b.exchanges[name]; ok {
+		if e.kind != kind {
+			return fmt.Errorf("exchange(%s): declared as %s", name, e.kind)
+		}
+		return nil
+	}
+	b.exchanges[name] = &exchange{kind: kind}
+	return nil
+}
+
+func (b *Broker) DeclareQueue(name string, options QueueOptions) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if q, ok := b.queues[name]; ok {
+		q.options = options
+		return
+	}
+	b.queues[name] = &queue{name: name, options: options, inFlight: make(map[uint64]*envelope)}
+}
+
+func (b *Broker) Bind(queue, exchange, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("exchange(%s): not found", exchange)
+	}
+	if _, ok := b.queues[queue]; !ok {
+		return fmt.Errorf("queue(%s): not found", queue)
+	}
+	e.bindings = append(e.bindings, binding{queue: queue, key: key})
+	return nil
+}
+
+// Publish routes m through exchange, the empty exchange delivers straight
+// to the queue named by m.Topic. Routing to no queue at all is an error,
+// as if published mandatory.
+func (b *Broker) Publish(exchange string, m *mq.Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.publish(exchange, m.Topic, m)
+}
+
+func (b *Broker) publish(exchange, key string, m *mq.Message) error {
+	var targets []string
+	if exchange == "" {
+		targets = []string{key}
+	} else if e, ok := b.exchanges[exchange]; !ok {
+		return fmt.Errorf("exchange(%s): not found", exchange)
+	} else {
+		for _, binding := range e.bindings {
+			if e.kind == Fanout ||
+				(e.kind == Direct && binding.key == key) ||
+				(e.kind == Topic && matchTopic(strings.Split(binding.key, "."), strings.Split(key, "."))) {
+				targets = append(targets, binding.queue)
+			}
+		}
+	}
+	routed := false
+	for _, name := range targets {
+		if q, ok := b.queues[name]; ok {
+			routed = true
+			copied := *m
+			copied.Attributes = make(map[string]string, len(m.Attributes))
+			for k, v := range m.Attributes {
+				copied.Attributes[k] = v
+			}
+			copied.Body = append([]byte(nil), m.Body...)
+			copied.Topic = key
+			q.ready = append(q.ready, &envelope{message: copied, enqueuedAt: b.now()})
+		}
+	}
+	if !routed {
+		return ErrUnroutable
+	}
+	return nil
+}
+
+// matchTopic follows rabbit, * is exactly one word, # zero or more.
+func matchTopic(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchTopic(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchTopic(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchTopic(pattern[1:], words[1:])
+	}
+}
+
+func (b *Broker) deadLetter(q *queue, e *envelope, reason string) {
+	if q.options.DeadLetterExchange == "" && q.options.DeadLetterRoutingKey == "" {
+		return
+	}
+	key := q.options.DeadLetterRoutingKey
+	if key == "" {
+		key = e.message.Topic
+	}
+	m := e.message
+	m.Attributes = make(map[string]string, len(e.message.Attributes)+3)
+	for k, v := range e.message.Attributes {
+		m.Attributes[k] = v
+	}
+	count, _ := strconv.Atoi(m.Attributes["x-death-count"])
+	m.Attributes["x-death-count"] = strconv.Itoa(count + 1)
+	m.Attributes["x-death-queue"] = q.name
+	m.Attributes["x-death-reason"] = reason
+	m.Redelivered, m.ReceiveCount = false, 0
+	_ = b.publish(q.options.DeadLetterExchange, key, &m)
+}
+
+// expire brings back messages whose visibility timeout elapsed and dead
+// letters ready ones older than the queue ttl.
+func (b *Broker) expire(q *queue) {
+	now := b.now()
+	for receipt, e := range q.inFlight {
+		if q.options.VisibilityTimeout > 0 && !now.Before(e.visibleAt) {
+			delete(q.inFlight, receipt)
+			q.ready = append(q.ready, e)
+		}
+	}
+	if q.options.MessageTTL > 0 {
+		ready := q.ready[:0]
+		for _, e := range q.ready {
+			if now.Sub(e.enqueuedAt) >= q.options.MessageTTL {
+				b.deadLetter(q, e, "expired")
+			} else {
+				ready = append(ready, e)
+			}
+		}
+		q.ready = ready
+	}
+}
+
+// Receive hands out the oldest visible message of queue, if any.
+func (b *Broker) Receive(queue string) (*Delivery, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, fmt.Errorf("queue(%s): not found", queue)
+	}
+	b.expire(q)
+	now := b.now()
+	for i := 0; i < len(q.ready); i++ {
+		e := q.ready[i]
+		if now.Before(e.visibleAt) {
+			continue
+		}
+		q.ready = append(q.ready[:i], q.ready[i+1:]...)
+		i--
+		if q.options.MaxReceiveCount > 0 && e.receiveCount >= q.options.MaxReceiveCount {
+			b.deadLetter(q, e, "maxReceiveCount")
+			continue
+		}
+		e.receiveCount++
+		b.receipt++
+		e.receipt = b.receipt
+		if q.options.VisibilityTimeout > 0 {
+			e.visibleAt = now.Add(q.options.VisibilityTimeout)
+		}
+		q.inFlight[e.receipt] = e
+		m := e.message
+		m.Redelivered, m.ReceiveCount = e.receiveCount > 1, e.receiveCount
+		return &Delivery{Message: &m, broker: b, queue: q, receipt: e.receipt}, nil
+	}
+	return nil, nil
+}
+
+func (b *Broker) settle(q *queue, receipt uint64, d mq.Disposition) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := q.inFlight[receipt]
+	if !ok {
+		return ErrStaleReceipt
+	}
+	delete(q.inFlight, receipt)
+	switch d.Action {
+	case mq.Acked, mq.Dropped:
+	case mq.Requeued:
+		e.visibleAt = time.Time{}
+		q.ready = append([]*envelope{e}, q.ready...)
+	case mq.Deferred:
+		e.visibleAt = b.now().Add(d.Delay)
+		q.ready = append(q.ready, e)
+	default:
+		b.deadLetter(q, e, "rejected")
+	}
+	return nil
+}
+
+// Len tells how many messages wait in queue and how many are in flight.
+func (b *Broker) Len(queue string) (ready, inFlight int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if q, ok := b.queues[queue]; ok {
+		b.expire(q)
+		return len(q.ready), len(q.inFlight)
+	}
+	return 0, 0
+}
+
+// Delivery is a received message waiting to be settled, once.
+type Delivery struct {
+	*mq.Message
+	broker  *Broker
+	queue   *queue
+	receipt uint64
+}
+
+func (d *Delivery) Ack() error                      { return d.Settle(nil) }
+func (d *Delivery) Nack(requeue bool) error         { return d.Settle(nackError(requeue)) }
+func (d *Delivery) Defer(delay time.Duration) error { return d.Settle(mq.RetryAfter(delay, nil)) }
+
+// Settle resolves err the way a handler result is, a plain error rejects.
+func (d *Delivery) Settle(err error) error {
+	return d.broker.settle(d.queue, d.receipt, mq.DispositionOf(err, mq.Rejected))
+}
+
+func nackError(requeue bool) error {
+	if requeue {
+		return mq.Requeue(nil)
+	}
+	return mq.Reject(nil)
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		now:       time.Now,
+		exchanges: make(map[string]*exchange),
+		queues:    make(map[string]*queue),
+	}
+}
@@ -0,0 +1,308 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/s4mli/bolsa/mq"
+)
+
+type clock struct{ now time.Time }
+
+func (c *clock) Now() time.Time          { return c.now }
+func (c *clock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestBroker(t *testing.T) (*Broker, *clock) {
+	t.Helper()
+	c := &clock{now: time.Date(2023, 5, 4, 10, 0, 0, 0, time.UTC)}
+	b := NewBroker()
+	b.SetClock(c.Now)
+	return b, c
+}
+
+func receive(t *testing.T, b *Broker, queue string) *Delivery {
+	t.Helper()
+	d, err := b.Receive(queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func expectLen(t *testing.T, b *Broker, queue string, ready, inFlight int) {
+	t.Helper()
+	if r, f := b.Len(queue); r != ready || f != inFlight {
+		t.Fatalf("%s: expected %d ready %d in flight, got %d and %d", queue, ready, inFlight, r, f)
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders.deleted", false},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.created.eu", false},
+		{"*.created", "orders.created", true},
+		{"orders.#", "orders", true},
+		{"orders.#", "orders.created.eu", true},
+		{"#", "orders.created", true},
+		{"#", "", true},
+		{"#.eu", "orders.created.eu", true},
+		{"#.eu", "orders.created.us", false},
+		{"orders.#.eu", "orders.eu", true},
+		{"orders.*.eu", "orders.eu", false},
+		{"*.#.*", "orders", false},
+		{"*.#.*", "orders.eu", true},
+	}
+	for _, test := range tests {
+		if match := matchTopic(strings.Split(test.pattern, "."), strings.Split(test.key, ".")); match != test.match {
+			t.Errorf("%q against %q: expected %v", test.pattern, test.key, test.match)
+		}
+	}
+}
+
+func TestRouting(t *testing.T) {
+	tests := []struct {
+		name     string
+		kind     string
+		bindings map[string]string
+		key      string
+		routed   []string
+	}{
+		{name: "direct", kind: Direct, key: "created",
+			bindings: map[string]string{"a": "created", "b": "deleted"}, routed: []string{"a"}},
+		{name: "direct unroutable", kind: Direct, key: "updated",
+			bindings: map[string]string{"a": "created"}},
+		{name: "topic", kind: Topic, key: "orders.created.eu",
+			bindings: map[string]string{"a": "orders.#", "b": "*.created.*", "c": "orders.*"},
+			routed:   []string{"a", "b"}},
+		{name: "fanout", kind: Fanout, key: "anything",
+			bindings: map[string]string{"a": "x", "b": "y"}, routed: []string{"a", "b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, _ := newTestBroker(t)
+			if err := b.DeclareExchange("events", test.kind); err != nil {
+				t.Fatal(err)
+			}
+			for queue, key := range test.bindings {
+				b.DeclareQueue(queue, QueueOptions{})
+				if err := b.Bind(queue, "events", key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := b.Publish("events", &mq.Message{Topic: test.key, Body: []byte("hi")})
+			if len(test.routed) == 0 {
+				if !errors.Is(err, ErrUnroutable) {
+					t.Fatalf("expected ErrUnroutable, got %v", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			var routed []string
+			for queue := range test.bindings {
+				if d := receive(t, b, queue); d != nil {
+					if d.Topic != test.key || string(d.Body) != "hi" {
+						t.Fatalf("%s: unexpected %+v", queue, d.Message)
+					}
+					routed = append(routed, queue)
+				}
+			}
+			sort.Strings(routed)
+			if strings.Join(routed, ",") != strings.Join(test.routed, ",") {
+				t.Fatalf("expected %v, got %v", test.routed, routed)
+			}
+		})
+	}
+}
+
+func TestDefaultExchange(t *testing.T) {
+	b, _ := newTestBroker(t)
+	b.DeclareQueue("work", QueueOptions{})
+	if err := b.Publish("", &mq.Message{Topic: "work"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("", &mq.Message{Topic: "missing"}); !errors.Is(err, ErrUnroutable) {
+		t.Fatalf("expected ErrUnroutable, got %v", err)
+	}
+	expectLen(t, b, "work", 1, 0)
+}
+
+func TestSettle(t *testing.T) {
+	tests := []struct {
+		name string
+		// settle is applied to the first delivery
+		settle func(*Delivery) error
+		// after is how long to wait before receiving again
+		after time.Duration
+		// redelivered tells whether work gets the message back then
+		redelivered bool
+		// dead tells whether it ended up in the dead letter queue
+		dead   bool
+		reason string
+	}{
+		{name: "ack", settle: (*Delivery).Ack},
+		{name: "drop", settle: func(d *Delivery) error { return d.Settle(mq.Drop(nil)) }},
+		{name: "requeue", settle: func(d *Delivery) error { return d.Nack(true) }, redelivered: true},
+		{name: "reject", settle: func(d *Delivery) error { return d.Nack(false) }, dead: true, reason: "rejected"},
+		{name: "plain error", settle: func(d *Delivery) error { return d.Settle(errors.New("boom")) },
+			dead: true, reason: "rejected"},
+		{name: "defer too early", settle: func(d *Delivery) error { return d.Defer(time.Minute) },
+			after: 59 * time.Second},
+		{name: "defer", settle: func(d *Delivery) error { return d.Defer(time.Minute) },
+			after: time.Minute, redelivered: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, c := newTestBroker(t)
+			b.DeclareQueue("work", QueueOptions{DeadLetterRoutingKey: "dead"})
+			b.DeclareQueue("dead", QueueOptions{})
+			if err := b.Publish("", &mq.Message{Id: "1", Topic: "work"}); err != nil {
+				t.Fatal(err)
+			}
+			d := receive(t, b, "work")
+			if d == nil || d.ReceiveCount != 1 || d.Redelivered {
+				t.Fatalf("unexpected first delivery %+v", d)
+			}
+			if err := test.settle(d); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Ack(); !errors.Is(err, ErrStaleReceipt) {
+				t.Fatalf("expected ErrStaleReceipt settling twice, got %v", err)
+			}
+			c.advance(test.after)
+			if again := receive(t, b, "work"); test.redelivered != (again != nil) {
+				t.Fatalf("expected redelivered %v, got %+v", test.redelivered, again)
+			} else if again != nil && (again.ReceiveCount != 2 || !again.Redelivered) {
+				t.Fatalf("unexpected redelivery %+v", again.Message)
+			}
+			dead := receive(t, b, "dead")
+			if test.dead != (dead != nil) {
+				t.Fatalf("expected dead lettered %v, got %+v", test.dead, dead)
+			} else if dead != nil && (dead.Attributes["x-death-reason"] != test.reason ||
+				dead.Attributes["x-death-queue"] != "work" || dead.Attributes["x-death-count"] != "1") {
+				t.Fatalf("unexpected dead letter %+v", dead.Attributes)
+			}
+		})
+	}
+}
+
+func TestVisibilityTimeout(t *testing.T) {
+	b, c := newTestBroker(t)
+	b.DeclareQueue("work", QueueOptions{
+		VisibilityTimeout:  30 * time.Second,
+		MaxReceiveCount:    2,
+		DeadLetterExchange: "dlx",
+	})
+	b.DeclareQueue("dead", QueueOptions{})
+	if err := b.DeclareExchange("dlx", Fanout); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Bind("dead", "dlx", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("", &mq.Message{Topic: "work"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first := receive(t, b, "work")
+	expectLen(t, b, "work", 0, 1)
+	c.advance(29 * time.Second)
+	if d := receive(t, b, "work"); d != nil {
+		t.Fatal("redelivered before the visibility timeout")
+	}
+	c.advance(time.Second)
+	second := receive(t, b, "work")
+	if second == nil || second.ReceiveCount != 2 || !second.Redelivered {
+		t.Fatalf("unexpected redelivery %+v", second)
+	}
+	if err := first.Ack(); !errors.Is(err, ErrStaleReceipt) {
+		t.Fatalf("expected ErrStaleReceipt for the first receipt, got %v", err)
+	}
+
+	c.advance(30 * time.Second)
+	if d := receive(t, b, "work"); d != nil {
+		t.Fatalf("received past MaxReceiveCount %+v", d.Message)
+	}
+	expectLen(t, b, "work", 0, 0)
+	if dead := receive(t, b, "dead"); dead == nil || dead.Attributes["x-death-reason"] != "maxReceiveCount" {
+		t.Fatalf("expected dead letter, got %+v", dead)
+	}
+}
+
+func TestMessageTTL(t *testing.T) {
+	b, c := newTestBroker(t)
+	b.DeclareQueue("work", QueueOptions{MessageTTL: time.Minute, DeadLetterRoutingKey: "dead"})
+	b.DeclareQueue("dead", QueueOptions{})
+	for _, id := range []string{"old", "new"} {
+		if err := b.Publish("", &mq.Message{Id: id, Topic: "work"}); err != nil {
+			t.Fatal(err)
+		}
+		c.advance(30 * time.Second)
+	}
+	expectLen(t, b, "work", 1, 0)
+	if dead := receive(t, b, "dead"); dead == nil || dead.Id != "old" ||
+		dead.Attributes["x-death-reason"] != "expired" {
+		t.Fatalf("expected old to expire, got %+v", dead)
+	}
+	if d := receive(t, b, "work"); d == nil || d.Id != "new" {
+		t.Fatalf("expected new, got %+v", d)
+	}
+}
+
+func TestConsume(t *testing.T) {
+	b, _ := newTestBroker(t)
+	b.DeclareQueue("work", QueueOptions{DeadLetterRoutingKey: "dead"})
+	b.DeclareQueue("dead", QueueOptions{})
+	var panics uint64
+	tests := []struct {
+		name    string
+		handler mq.Handler
+		dead    bool
+	}{
+		{name: "ack", handler: func(context.Context, *mq.Message) error { return nil }},
+		{name: "reject", handler: func(context.Context, *mq.Message) error { return errors.New("boom") }, dead: true},
+		{name: "panic", handler: func(context.Context, *mq.Message) error { panic("boom") }, dead: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := b.Publish("", &mq.Message{Topic: "work"}); err != nil {
+				t.Fatal(err)
+			}
+			if handled, err := b.Consume(context.Background(), "work", test.handler, &panics); !handled || err != nil {
+				t.Fatalf("expected handled, got %v %v", handled, err)
+			}
+			expectLen(t, b, "work", 0, 0)
+			if dead := receive(t, b, "dead"); test.dead != (dead != nil) {
+				t.Fatalf("expected dead lettered %v", test.dead)
+			}
+		})
+	}
+	if panics != 1 {
+		t.Fatalf("expected one panic, got %d", panics)
+	}
+}
+
+func TestOpenIsolatesBrokers(t *testing.T) {
+	first, err := mq.Open("memory", map[string]interface{}{"workers": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := mq.Open("memory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := first.(*Transport), second.(*Transport)
+	if a.Workers != 2 || a.Broker == nil || a.Broker == b.Broker {
+		t.Fatalf("expected separate brokers, got %+v and %+v", a, b)
+	}
+}
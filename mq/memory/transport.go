@@ -0,0 +1,124 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/s4mli/bolsa/mq"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	mq.Register("memory", func() mq.Transport { return &Transport{Broker: NewBroker()} })
+}
+
+// Transport runs the in memory broker behind the mq interfaces, a
+// destination is an exchange and a source a queue, both declared upfront.
+// Each transport opened through mq.Open gets a Broker of its own, shared by
+// its publishers and consumers only so tests don't leak into each other,
+// one built by hand without a Broker too.
+type Transport struct {
+	Broker  *Broker `yaml:"-"`
+	Workers int     `yaml:"workers"`
+	once    sync.Once
+}
+
+func (t *Transport) broker() *Broker {
+	t.once.Do(func() {
+		if t.Broker == nil {
+			t.Broker = NewBroker()
+		}
+	})
+	return t.Broker
+}
+
+func (t *Transport) RunPublisher(
+	_ context.Context,
+	destination string,
+	published mq.OnPublished,
+	_ logrus.FieldLogger,
+) mq.Publisher {
+	return &publisher{broker: t.broker(), exchange: destination, published: published}
+}
+
+func (t *Transport) RunConsumer(
+	ctx context.Context,
+	source string,
+	handler mq.Handler,
+	logger logrus.FieldLogger,
+) mq.Consumer {
+	c := &consumer{broker: t.broker(), queue: source, handler: handler,
+		logger: logger.WithField("#", fmt.Sprintf("MEM:C(%s)", source))}
+	workers := t.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	for id := 0; id < workers; id++ {
+		go c.run(ctx)
+	}
+	return c
+}
+
+type publisher struct {
+	broker    *Broker
+	exchange  string
+	published mq.OnPublished
+}
+
+// Publish is synchronous, published is called before it returns.
+func (p *publisher) Publish(m *mq.Message) error {
+	err := p.broker.Publish(p.exchange, m)
+	if p.published != nil {
+		p.published(m, err)
+	}
+	return err
+}
+
+func (p *publisher) PublishJson(topic string, v interface{}) error {
+	if body, err := json.Marshal(v); err != nil {
+		return err
+	} else {
+		return p.Publish(&mq.Message{Topic: topic, ContentType: "application/json", Body: body})
+	}
+}
+
+type consumer struct {
+	broker  *Broker
+	queue   string
+	handler mq.Handler
+	panics  uint64
+	logger  logrus.FieldLogger
+}
+
+func (c *consumer) Panics() uint64 { return atomic.LoadUint64(&c.panics) }
+
+func (c *consumer) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			if handled, err := c.broker.Consume(ctx, c.queue, c.handler, &c.panics); err != nil {
+				c.logger.WithField("&", "run").Error(err)
+				time.Sleep(50 * time.Millisecond)
+			} else if !handled {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+}
+
+// Consume receives one message from queue and settles it with what handler
+// returned, in the calling goroutine, so tests can step through a flow.
+// A handler panic rejects the message and is counted in panics if given.
+func (b *Broker) Consume(ctx context.Context, queue string, handler mq.Handler, panics *uint64) (bool, error) {
+	d, err := b.Receive(queue)
+	if err != nil || d == nil {
+		return false, err
+	}
+	return true, d.Settle(mq.Invoke(panics, nil, func() error { return handler(ctx, d.Message) }))
+}
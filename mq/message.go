@@ -0,0 +1,37 @@
+package mq
+
+import (
+	"context"
+	"time"
+)
+
+// Message is what travels through any transport. Topic is the routing key
+// on rabbit and the topic arn an SNS notification came from. Attributes are
+// headers on rabbit and message attributes on SNS/SQS.
+type Message struct {
+	Id          string
+	Topic       string
+	ContentType string
+	Attributes  map[string]string
+	Body        []byte
+	// set on consumed messages only, ReceiveCount by SQS only
+	Redelivered  bool
+	ReceiveCount int
+	Timestamp    time.Time
+}
+
+type Handler func(context.Context, *Message) error
+
+// OnPublished is called once per message, Id is filled in with what the
+// broker assigned when it has one.
+type OnPublished func(message *Message, failed error)
+
+type Publisher interface {
+	Publish(*Message) error
+	PublishJson(topic string, v interface{}) error
+}
+
+type Consumer interface {
+	// Panics counts handler panics recovered by all workers.
+	Panics() uint64
+}
@@ -0,0 +1,46 @@
+package mq
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PanicError carries a panic recovered from a handler.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string { return fmt.Sprintf("panic: %v", e.Value) }
+
+// Recovered calls handle, a panic comes back as a Disposition of action
+// wrapping a *PanicError.
+func Recovered(action Action, handle func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &Disposition{Action: action, Err: &PanicError{Value: r, Stack: debug.Stack()}}
+		}
+	}()
+	return handle()
+}
+
+// Invoke is how consumer workers call a handler and stay alive whatever it
+// does, a panic is rejected unless the handler says otherwise (OnPanic on
+// the transport handlers), counted in panics and logged, either if given.
+func Invoke(panics *uint64, logger logrus.FieldLogger, handle func() error) error {
+	err := Recovered(Rejected, handle)
+	var p *PanicError
+	if errors.As(err, &p) {
+		if panics != nil {
+			atomic.AddUint64(panics, 1)
+		}
+		if logger != nil {
+			logger.Errorf("%v\n%s", p, p.Stack)
+		}
+	}
+	return err
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/streadway/amqp"
 )
 
+const declareRetryInterval = 5 * time.Second
+
 type Channel struct {
 	*medium
 	*Connection
@@ -15,53 +17,85 @@ type Channel struct {
 	id                   int
 	prefetchCount        int
 	prefetchSize         int
+	topology             *Topology
 	connectionTerminated chan struct{}
 }
 
 func (c *Channel) Name() string { return fmt.Sprintf("🔗(%05d)", c.id) }
 func (c *Channel) Stop()        {}
 
-func (c *Channel) establishAndMonitorChannel(teared chan<- struct{}) {
-	c.logger.WithField("&", "Start").Debug("=> Channel")
-	if c.Channel = c.Connection.Channel(c.prefetchCount, c.prefetchSize); c.Channel != nil {
-		c.logger.WithField("&", "Start").Debug("=> NotifyEstablished")
-		c.Notify(&c.established)
+func (c *Channel) connectionClosed() bool {
+	conn := c.Connection.conn()
+	return conn == nil || conn.IsClosed()
+}
 
-		go func() {
-			if err := <-c.Channel.NotifyClose(make(chan *amqp.Error, 1)); err != nil {
-				c.logger.WithField("&", "Monitor").Error("=> Dropped: ", err)
-				c.logger.WithField("&", "Monitor").Debug("=> NotifyTerminated")
-				c.Notify(&c.terminated)
-				c.logger.WithField("&", "Monitor").Debug("=> Await")
-				c.Await()
+// establishAndMonitorChannel opens the channel and declares the topology,
+// trying again a bit later while either fails, then monitors it. A
+// conflicting declaration closes the channel without anybody being told,
+// hence starting from scratch each time. It tells whether the connection
+// terminated meanwhile, by terminated, listening is restarted then.
+func (c *Channel) establishAndMonitorChannel(teared chan<- struct{}, terminated <-chan struct{}) bool {
+	for {
+		c.logger.WithField("&", "Start").Debug("=> Channel")
+		if c.Channel = c.Connection.Channel(c.prefetchCount, c.prefetchSize); c.Channel != nil {
+			c.logger.WithField("&", "Start").Debug("=> Declare")
+			if err := c.topology.declare(c.Channel); err == nil {
+				break
+			} else {
+				c.logger.WithField("&", "Start").Error("=> Declare failed: ", err)
+				_ = c.Channel.Close()
+				c.Channel = nil
+			}
+		}
+		select {
+		case <-c.ctx.Done():
+			return false
+		case <-terminated:
+			c.logger.WithField("&", "Start").Info("=> Terminated meanwhile, Restart")
+			c.Start()
+			c.tearDown(teared)
+			return true
+		case <-time.After(declareRetryInterval):
+		}
+	}
+	c.logger.WithField("&", "Start").Debug("=> NotifyEstablished")
+	c.Notify(&c.established)
+
+	go func() {
+		if err := <-c.Channel.NotifyClose(make(chan *amqp.Error, 1)); err != nil {
+			c.logger.WithField("&", "Monitor").Error("=> Dropped: ", err)
+			c.logger.WithField("&", "Monitor").Debug("=> NotifyTerminated")
+			c.Notify(&c.terminated)
+			c.logger.WithField("&", "Monitor").Debug("=> Await")
+			c.Await()
+			/*
+				publish to non-existing exchange can also kill the channel but not the connection
+			*/
+			if c.connectionClosed() {
 				/*
-					publish to non-existing exchange can also kill the channel but not the connection
+					wait for connection to be terminated
 				*/
-				if c.IsClosed() {
-					/*
-						wait for connection to be terminated
-					*/
-					c.logger.WithField("&", "Monitor").Debug("=> Wait connection terminated")
-					<-c.connectionTerminated
-					/*
-						restart to listen on events first
-					*/
-					c.logger.WithField("&", "Monitor").Info("=> Restart")
-					c.Start()
-					/*
-						tell connection you may restart
-					*/
-					c.logger.WithField("&", "Monitor").Info("=> Teared")
-					c.tearDown(teared)
-				} else {
-					/*
-						connection is alive just refresh channel and monitor it
-					*/
-					c.establishAndMonitorChannel(teared)
-				}
+				c.logger.WithField("&", "Monitor").Debug("=> Wait connection terminated")
+				<-c.connectionTerminated
+				/*
+					restart to listen on events first
+				*/
+				c.logger.WithField("&", "Monitor").Info("=> Restart")
+				c.Start()
+				/*
+					tell connection you may restart
+				*/
+				c.logger.WithField("&", "Monitor").Info("=> Teared")
+				c.tearDown(teared)
+			} else {
+				/*
+					connection is alive just refresh channel and monitor it
+				*/
+				c.establishAndMonitorChannel(teared, c.connectionTerminated)
 			}
-		}()
-	}
+		}
+	}()
+	return false
 }
 
 func (c *Channel) Start() {
@@ -75,9 +109,11 @@ func (c *Channel) Start() {
 				c.cancel()
 				c.logger.WithField("&", "Stop").Debug("=> Await")
 				c.Await()
-				c.logger.WithField("&", "Stop").Debug("=> Close")
-				if err := c.Channel.Close(); err != nil {
-					c.logger.WithField("&", "Stop").Error("=> Close failed: ", err)
+				if c.Channel != nil {
+					c.logger.WithField("&", "Stop").Debug("=> Close")
+					if err := c.Channel.Close(); err != nil {
+						c.logger.WithField("&", "Stop").Error("=> Close failed: ", err)
+					}
 				}
 				c.logger.WithField("&", "Stop").Info("=> Clean")
 				c.Clean()
@@ -92,7 +128,9 @@ func (c *Channel) Start() {
 				return
 			case <-established:
 				c.logger.WithField("&", "Start").Info("=> Established")
-				c.establishAndMonitorChannel(teared)
+				if c.establishAndMonitorChannel(teared, terminated) {
+					return
+				}
 			default:
 				time.Sleep(50 * time.Millisecond)
 			}
@@ -104,6 +142,7 @@ func NewChannel(
 	id int,
 	connection *Connection,
 	prefetchCount, prefetchSize int,
+	topology *Topology,
 	logger logrus.FieldLogger,
 ) *Channel {
 	c := &Channel{
@@ -112,6 +151,7 @@ func NewChannel(
 		id:                   id,
 		prefetchCount:        prefetchCount,
 		prefetchSize:         prefetchSize,
+		topology:             topology,
 		connectionTerminated: make(chan struct{}, 1),
 	}
 	c.medium = NewMedium(connection.Context(), logger.WithField("#", c.Name()))
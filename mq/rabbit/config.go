@@ -0,0 +1,98 @@
+package rabbit
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Config tells how to reach the broker, one node per entry. URLs are full
+// amqp:// or amqps:// urls, otherwise every host[:port] of Endpoints is
+// combined with User, Password and TLS (amqps when set). Vhost, when set,
+// wins over the one in the url.
+type Config struct {
+	URLs       []string      `yaml:"urls"`
+	Endpoints  []string      `yaml:"endpoints"`
+	User       string        `yaml:"user"`
+	Password   string        `yaml:"password"`
+	Vhost      string        `yaml:"vhost"`
+	TLS        *tls.Config   `yaml:"-"`
+	Heartbeat  time.Duration `yaml:"heartbeat"`
+	FrameSize  int           `yaml:"frameSize"`
+	ChannelMax int           `yaml:"channelMax"`
+	Locale     string        `yaml:"locale"`
+	// Name shows up as connection_name in the management UI
+	Name       string           `yaml:"name"`
+	Properties amqp.Table       `yaml:"properties"`
+	Reconnect  *ReconnectPolicy `yaml:"reconnect"`
+}
+
+func (c *Config) urls() []string {
+	if len(c.URLs) > 0 {
+		return c.URLs
+	}
+	scheme := "amqp"
+	if c.TLS != nil {
+		scheme = "amqps"
+	}
+	urls := make([]string, 0, len(c.Endpoints))
+	for _, endpoint := range c.Endpoints {
+		u := &url.URL{Scheme: scheme, Host: endpoint, Path: "/"}
+		if c.User != "" {
+			u.User = url.UserPassword(c.User, c.Password)
+		}
+		urls = append(urls, u.String())
+	}
+	return urls
+}
+
+func (c *Config) user() string {
+	if len(c.URLs) > 0 {
+		if uri, err := amqp.ParseURI(c.URLs[0]); err == nil {
+			return uri.Username
+		}
+	}
+	return c.User
+}
+
+func (c *Config) amqp() amqp.Config {
+	config := amqp.Config{
+		Vhost:      c.Vhost,
+		ChannelMax: c.ChannelMax,
+		FrameSize:  c.FrameSize,
+		Heartbeat:  c.Heartbeat,
+		Locale:     c.Locale,
+		Properties: amqp.Table{},
+	}
+	if c.TLS != nil {
+		/*
+			the driver fills in ServerName per dial, never share it across nodes
+		*/
+		config.TLSClientConfig = c.TLS.Clone()
+	}
+	if config.Heartbeat == 0 {
+		config.Heartbeat = 10 * time.Second
+	}
+	if config.Locale == "" {
+		config.Locale = "en_US"
+	}
+	for k, v := range c.Properties {
+		config.Properties[k] = v
+	}
+	if c.Name != "" {
+		config.Properties["connection_name"] = c.Name
+	}
+	return config
+}
+
+// redact drops credentials so an url can be logged.
+func redact(rawURL string) string {
+	if uri, err := amqp.ParseURI(rawURL); err != nil {
+		return "?"
+	} else {
+		return fmt.Sprintf("%s://%s:%d/%s", uri.Scheme, uri.Host, uri.Port, uri.Vhost)
+	}
+}
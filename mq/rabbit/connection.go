@@ -1,7 +1,12 @@
 package rabbit
 
 import (
+	"errors"
 	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/s4mli/bolsa/cleaner"
 	"github.com/sirupsen/logrus"
@@ -9,46 +14,137 @@ import (
 	"golang.org/x/net/context"
 )
 
+var errNoEndpoints = errors.New("no endpoints")
+
+// Connection redials by itself, the embedded amqp.Connection and the node
+// it is attached to change then, which conn and Endpoint read safely.
 type Connection struct {
 	*medium
 	*amqp.Connection
-	uri, user, password string
+	config Config
+	urls   []string
+	url    string
+	mu     sync.RWMutex
+	policy ReconnectPolicy
+	state  int32
+}
+
+func (c *Connection) conn() *amqp.Connection {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Connection
+}
+
+func (c *Connection) attached() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.url
 }
 
-func (c *Connection) Name() string { return fmt.Sprintf("⚡(%s)", c.user) }
+func (c *Connection) attach(conn *amqp.Connection, url string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Connection, c.url = conn, url
+}
+
+func (c *Connection) Name() string { return fmt.Sprintf("⚡(%s)", c.config.user()) }
 func (c *Connection) Stop() {
 	c.cancel()
 	c.logger.WithField("&", "Stop").Debug("=> Await")
 	c.Await()
-	c.logger.WithField("&", "Stop").Debug("=> Close")
-	if err := c.Close(); err != nil {
-		c.logger.WithField("&", "Stop").Error("=> Close failed: ", err)
+	if conn := c.conn(); conn != nil {
+		c.logger.WithField("&", "Stop").Debug("=> Close")
+		if err := conn.Close(); err != nil {
+			c.logger.WithField("&", "Stop").Error("=> Close failed: ", err)
+		}
 	}
 	c.logger.WithField("&", "Stop").Info("=> Clean")
 	c.Clean()
+	c.setState(Closed, 0, nil)
 	c.logger.WithField("&", "Stop").Info("=> Stopped")
 }
 
-func (c *Connection) Start() {
-	connect := func() *amqp.Connection {
-		if conn, err := amqp.Dial(fmt.Sprintf("amqp://%s:%s@%s/",
-			c.user, c.password, c.uri)); err != nil {
-			c.logger.WithField("&", "dial").Error(err)
-			return nil
-		} else {
-			return conn
+// Endpoint is the node currently attached to, or the last one.
+func (c *Connection) Endpoint() string { return redact(c.attached()) }
+func (c *Connection) State() ConnectionState {
+	return ConnectionState(atomic.LoadInt32(&c.state))
+}
+
+func (c *Connection) setState(state ConnectionState, attempt int, err error) {
+	atomic.StoreInt32(&c.state, int32(state))
+	c.policy.notify(state, attempt, err)
+}
+
+// endpoints lists the nodes for one round of dialing, in order it starts
+// right after the last attached node so a dropped node is tried last.
+func (c *Connection) endpoints() []string {
+	endpoints := make([]string, 0, len(c.urls))
+	if c.policy.Shuffle {
+		for _, i := range rand.Perm(len(c.urls)) {
+			endpoints = append(endpoints, c.urls[i])
+		}
+	} else {
+		start, attached := 0, c.attached()
+		for i, url := range c.urls {
+			if url == attached {
+				start = i + 1
+			}
+		}
+		for i := range c.urls {
+			endpoints = append(endpoints, c.urls[(start+i)%len(c.urls)])
 		}
 	}
+	return endpoints
+}
 
-	c.logger.WithField("&", "Start").Debug("=> Connect")
-	if conn := connect(); conn != nil {
-		c.Connection = conn
-		c.logger.WithField("&", "Start").Debug("=> NotifyEstablished")
-		c.Notify(&c.established)
+// dial until connected, stopped or the policy gives up, never panic,
+// whoever waits for established simply keeps waiting. Every attempt goes
+// through all endpoints once, without any it gives up right away.
+func (c *Connection) dial() (*amqp.Connection, string) {
+	if len(c.urls) == 0 {
+		c.logger.WithField("&", "Dial").Error("=> Gave up: ", errNoEndpoints)
+		c.setState(GaveUp, 0, errNoEndpoints)
+		return nil, ""
+	}
+	for attempt := 1; ; attempt++ {
+		c.setState(Connecting, attempt, nil)
+		var err error
+		for _, url := range c.endpoints() {
+			var conn *amqp.Connection
+			if conn, err = amqp.DialConfig(url, c.config.amqp()); err == nil {
+				c.logger.WithField("&", "Dial").Info("=> Attached to ", redact(url))
+				return conn, url
+			}
+			c.logger.WithField("&", "Dial").Errorf("=> Attempt(%d) %s failed: %s",
+				attempt, redact(url), err)
+		}
+		c.policy.notify(Connecting, attempt, err)
+		if c.policy.exhausted(attempt) {
+			c.logger.WithField("&", "Dial").Errorf("=> Gave up after %d attempts", attempt)
+			c.setState(GaveUp, attempt, err)
+			return nil, ""
+		}
+		select {
+		case <-c.ctx.Done():
+			return nil, ""
+		case <-time.After(c.policy.backoff(attempt)):
+		}
+	}
+}
 
-		go func() {
-			if err := <-c.NotifyClose(make(chan *amqp.Error, 1)); err != nil {
+func (c *Connection) Start() {
+	go func() {
+		c.logger.WithField("&", "Start").Debug("=> Connect")
+		if conn, url := c.dial(); conn != nil {
+			closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+			c.attach(conn, url)
+			c.setState(Connected, 0, nil)
+			c.logger.WithField("&", "Start").Debug("=> NotifyEstablished")
+			c.Notify(&c.established)
+
+			if err := <-closed; err != nil {
 				c.logger.WithField("&", "Monitor").Error("=> Dropped: ", err)
+				c.setState(Disconnected, 0, err)
 				c.logger.WithField("&", "Monitor").Debug("=> NotifyTerminated")
 				c.Notify(&c.terminated)
 				c.logger.WithField("&", "Monitor").Debug("=> Await")
@@ -56,14 +152,17 @@ func (c *Connection) Start() {
 				c.logger.WithField("&", "Monitor").Info("=> Restart")
 				c.Start()
 			}
-		}()
-	} else {
-		panic(fmt.Errorf("unable to establish connection"))
-	}
+		}
+	}()
 }
 
 func (c *Connection) Channel(prefetchCount, prefetchSize int) *amqp.Channel {
-	if qChan, err := c.Connection.Channel(); err != nil {
+	conn := c.conn()
+	if conn == nil {
+		c.logger.WithField("&", "Channel").Error("=> Channel failed: not connected")
+		return nil
+	}
+	if qChan, err := conn.Channel(); err != nil {
 		c.logger.WithField("&", "Channel").Error("=> Channel failed: ", err)
 		return nil
 	} else {
@@ -78,14 +177,18 @@ func (c *Connection) Channel(prefetchCount, prefetchSize int) *amqp.Channel {
 
 func NewConnection(
 	ctx context.Context,
-	uri, user, password string,
+	config Config,
 	logger logrus.FieldLogger,
 ) *Connection {
 	c := &Connection{
 		Connection: nil,
-		uri:        uri,
-		user:       user,
-		password:   password,
+		config:     config,
+		urls:       config.urls(),
+		policy:     DefaultReconnectPolicy,
+		state:      int32(Disconnected),
+	}
+	if config.Reconnect != nil {
+		c.policy = config.Reconnect.withDefaults()
 	}
 	c.medium = NewMedium(ctx, logger.WithField("#", c.Name()))
 	cleaner.Register(c)
@@ -1,36 +1,45 @@
 package rabbit
 
 import (
+	"sync/atomic"
+
 	"github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
 	"golang.org/x/net/context"
 )
 
-type MessageHandler func(amqp.Table, []byte) error
-
-func (mh MessageHandler) handle(headers amqp.Table, body []byte) error { return mh(headers, body) }
-
 type consumer struct {
 	connection *Connection
 	workers    map[int]*consumerWorker
 }
 
+// Panics counts handler panics recovered by all workers.
+func (c *consumer) Panics() uint64 {
+	var panics uint64
+	for _, w := range c.workers {
+		panics += atomic.LoadUint64(&w.panics)
+	}
+	return panics
+}
+
 func newConsumer(
 	ctx context.Context,
-	uri, user, password, name string,
+	config Config,
+	name string,
 	prefetchCount, prefetchSize, count int,
-	handler MessageHandler,
+	topology *Topology,
+	handler Handler,
+	retry *delayedRetry,
 	logger logrus.FieldLogger,
 ) *consumer {
-	connection := NewConnection(ctx, uri, user, password, logger)
+	connection := NewConnection(ctx, config, logger)
 	c := &consumer{
 		connection: connection,
 		workers: func() map[int]*consumerWorker {
 			workers := make(map[int]*consumerWorker, count)
 			for id := 0; id < count; id++ {
 				workers[id] = newConsumerWorker(
-					NewChannel(id+1, connection, prefetchCount, prefetchSize, logger),
-					id+1, name, handler, logger,
+					NewChannel(id+1, connection, prefetchCount, prefetchSize, topology, logger),
+					id+1, name, handler, retry, logger,
 				).run()
 			}
 			return workers
@@ -40,10 +49,10 @@ func newConsumer(
 	return c
 }
 
-type RetryLimitReached func(exchange, queue string, routeKeys []interface{}, body []byte)
+type RetryLimitReached func(exchange, queue string, routeKeys []string, deaths XDeaths, body []byte)
 
-func (rlr RetryLimitReached) handle(exchange, queue string, routeKeys []interface{}, body []byte) {
-	rlr(exchange, queue, routeKeys, body)
+func (rlr RetryLimitReached) handle(exchange, queue string, routeKeys []string, deaths XDeaths, body []byte) {
+	rlr(exchange, queue, routeKeys, deaths, body)
 }
 
 type retryableConsumer struct {
@@ -53,38 +62,50 @@ type retryableConsumer struct {
 
 func RunConsumer(
 	ctx context.Context,
-	uri, user, password, name string,
-	prefetchCount, prefetchSize, count, limit int,
-	handler MessageHandler,
-	rlr RetryLimitReached,
+	config Config,
+	name string,
+	prefetchCount, prefetchSize, count int,
+	handler Handler,
+	options ConsumerOptions,
 	logger logrus.FieldLogger,
 ) *retryableConsumer {
-	retryableHandler := func() MessageHandler {
-		return func(headers amqp.Table, body []byte) error {
-			if xDeaths, ok := headers["x-death"]; ok {
-				xDeaths, _ := xDeaths.([]interface{})
-				xDeath, _ := xDeaths[1].(amqp.Table)
-				exchange, _ := xDeath["exchange"].(string)
-				queue, _ := xDeath["queue"].(string)
-				routeKeys, _ := xDeath["routing-keys"].([]interface{})
-				retried, _ := xDeath["count"].(int64)
+	options = options.withDefaults()
+	limit, rlr := options.RetryLimit, options.RetryLimitReached
+	retryableHandler := func() Handler {
+		return func(ctx context.Context, d *Delivery) error {
+			/*
+				only deaths in our own queue count as retries, the same
+				message may have been dead-lettered elsewhere before.
+			*/
+			if own := d.Deaths.Of(name); len(own) > 0 {
+				retried := own.Count(name)
 				if limit > 0 && int(retried) >= limit {
 					if rlr != nil {
-						rlr.handle(exchange, queue, routeKeys, body)
+						rlr.handle(own[0].Exchange, name, own[0].RoutingKeys, d.Deaths, d.Body)
 					}
 					return nil
-				} else {
-					return handler.handle(headers, body)
 				}
-			} else {
-				return handler.handle(headers, body)
 			}
+			return handler.handle(ctx, d)
+		}
+	}
+
+	if retry := newDelayedRetry(name, options); retry != nil {
+		/*
+			built-in retry, failures are moved through the wait queues and
+			counted by ourselves, x-death is left alone.
+		*/
+		return &retryableConsumer{
+			consumer: newConsumer(ctx, config, name, prefetchCount, prefetchSize,
+				count, options.Topology.withQueues(retry.queues()...), handler, retry,
+				logger.WithField("Retry", limit)),
+			limit: limit,
 		}
 	}
 
 	rc := &retryableConsumer{
-		consumer: newConsumer(ctx, uri, user, password, name, prefetchCount, prefetchSize,
-			count, retryableHandler(), logger.WithField("Retry", limit)),
+		consumer: newConsumer(ctx, config, name, prefetchCount, prefetchSize,
+			count, options.Topology, retryableHandler(), nil, logger.WithField("Retry", limit)),
 		limit: limit,
 	}
 	return rc
@@ -5,22 +5,101 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/s4mli/bolsa/mq"
 	"github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
 )
 
 type consumerWorker struct {
-	ctx     context.Context
-	cancel  context.CancelFunc
-	channel *Channel
-	id      int
-	name    string
-	handler MessageHandler
-	logger  logrus.FieldLogger
+	ctx      context.Context
+	cancel   context.CancelFunc
+	channel  *Channel
+	id       int
+	name     string
+	handler  Handler
+	retry    *delayedRetry
+	deferred bool
+	panics   uint64
+	logger   logrus.FieldLogger
 }
 
 func (w *consumerWorker) Name() string { return fmt.Sprintf("C(%s)(%05d)", w.name, w.id) }
-func (w *consumerWorker) consume(msgCh <-chan amqp.Delivery) {
+func (w *consumerWorker) ack(m amqp.Delivery) {
+	w.logger.WithField("&", "Consume").Debug("=> Ack")
+	if err := m.Ack(false); err != nil {
+		w.logger.WithField("&", "Consume").Error("=> Ack failed: ", err)
+	}
+}
+
+func (w *consumerWorker) nack(m amqp.Delivery, requeue bool) {
+	w.logger.WithField("&", "Consume").Debug("=> Nack, requeue ", requeue)
+	if err := m.Nack(false, requeue); err != nil {
+		w.logger.WithField("&", "Consume").Error("=> Nack failed: ", err)
+	}
+}
+
+func (w *consumerWorker) schedule(rp *republisher, m amqp.Delivery, delay time.Duration) {
+	w.logger.WithField("&", "Consume").Debug("=> Retry")
+	if err := w.retry.schedule(rp.publish, m, delay); err != nil {
+		w.logger.WithField("&", "Consume").Error("=> Retry failed: ", err)
+		w.nack(m, true)
+	} else {
+		w.ack(m)
+	}
+}
+
+// deferTo parks m in the deferred queue, declared on first use, for
+// handlers asking for a delay without the built-in retry.
+func (w *consumerWorker) deferTo(rp *republisher, m amqp.Delivery, delay time.Duration) {
+	w.logger.WithField("&", "Consume").Debug("=> Defer ", delay)
+	var err error
+	if !w.deferred {
+		q := deferredQueue(w.name)
+		if _, err = w.channel.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Args); err == nil {
+			w.deferred = true
+		}
+	}
+	if err == nil {
+		err = deferTo(rp.publish, w.name, m, delay)
+	}
+	if err != nil {
+		w.logger.WithField("&", "Consume").Error("=> Defer failed: ", err)
+		w.nack(m, true)
+	} else {
+		w.ack(m)
+	}
+}
+
+// a plain error goes through the built-in retry when there is one,
+// otherwise it's rejected, exactly as before dispositions.
+func (w *consumerWorker) settle(rp *republisher, m amqp.Delivery, err error) {
+	fallback := mq.Rejected
+	if w.retry != nil {
+		fallback = mq.Deferred
+	}
+	d := mq.DispositionOf(err, fallback)
+	if err != nil {
+		w.logger.WithField("&", "Consume").Errorf("=> Handle failed(%s): %s", d.Action, err)
+	}
+	switch d.Action {
+	case mq.Acked, mq.Dropped:
+		w.ack(m)
+	case mq.Requeued:
+		w.nack(m, true)
+	case mq.Deferred:
+		if w.retry != nil {
+			w.schedule(rp, m, d.Delay)
+		} else if d.Delay > 0 {
+			w.deferTo(rp, m, d.Delay)
+		} else {
+			w.nack(m, true)
+		}
+	default:
+		w.nack(m, false)
+	}
+}
+
+func (w *consumerWorker) consume(msgCh <-chan amqp.Delivery, rp *republisher) {
 	/*
 		Continues deliveries to the returned chan Delivery until Channel.Cancel,
 		Connection.Close, Channel.Close, or an AMQP exception occurs.  Consumers must
@@ -30,18 +109,9 @@ func (w *consumerWorker) consume(msgCh <-chan amqp.Delivery) {
 	go func() {
 		for m := range msgCh {
 			w.logger.WithField("&", "Consume").Debug("=> Handle")
-			if err := w.handler.handle(m.Headers, m.Body); err != nil {
-				w.logger.WithField("&", "Consume").Error("=> Handle failed: ", err)
-				w.logger.WithField("&", "Consume").Debug("=> Nack")
-				if e := m.Nack(false, false); e != nil {
-					w.logger.WithField("&", "Consume").Error("=> Nack failed: ", err)
-				}
-			} else {
-				w.logger.WithField("&", "Consume").Debug("=> Ack")
-				if e := m.Ack(false); e != nil {
-					w.logger.WithField("&", "Consume").Error("=> Ack failed: ", err)
-				}
-			}
+			w.settle(rp, m, mq.Invoke(&w.panics, w.logger.WithField("&", "Consume"), func() error {
+				return w.handler.handle(w.ctx, newDelivery(m))
+			}))
 		}
 		w.logger.WithField("&", "Consume").Info("=> Stopped")
 	}()
@@ -56,7 +126,7 @@ func (w *consumerWorker) run() *consumerWorker {
 			select {
 			case <-w.ctx.Done():
 				w.cancel()
-				if w.channel != nil {
+				if w.channel.Channel != nil {
 					w.logger.WithField("&", "Stop").Debug("=> Cancel")
 					if err := w.channel.Cancel(w.Name(), false); err != nil {
 						w.logger.WithField("&", "Stop").Error("=> Cancel failed: ", err)
@@ -77,6 +147,16 @@ func (w *consumerWorker) run() *consumerWorker {
 				w.logger.WithField("&", "Terminate").Info("=> Still alive")
 			case <-established:
 				w.logger.WithField("&", "Run").Info("=> Established")
+				/*
+					retries and deferrals are republished on this very channel,
+					in confirm mode so the original is acked only once they're in.
+				*/
+				w.logger.WithField("&", "Run").Debug("=> Confirm")
+				rp, err := newRepublisher(w.channel.Channel, defaultConfirmTimeout)
+				if err != nil {
+					w.logger.WithField("&", "Run").Error("=> Confirm failed: ", err)
+					continue
+				}
 				w.logger.WithField("&", "Run").Debug("=> Consume")
 				if msgCh, err := w.channel.Consume(
 					w.name,
@@ -88,7 +168,7 @@ func (w *consumerWorker) run() *consumerWorker {
 					nil); err != nil {
 					w.logger.WithField("&", "Run").Error("=> Consume failed: ", err)
 				} else {
-					w.consume(msgCh)
+					w.consume(msgCh, rp)
 				}
 			default:
 				time.Sleep(50 * time.Millisecond)
@@ -103,7 +183,8 @@ func newConsumerWorker(
 	channel *Channel,
 	id int,
 	name string,
-	handler MessageHandler,
+	handler Handler,
+	retry *delayedRetry,
 	logger logrus.FieldLogger,
 ) *consumerWorker {
 	cw := &consumerWorker{
@@ -111,6 +192,7 @@ func newConsumerWorker(
 		id:      id,
 		name:    name,
 		handler: handler,
+		retry:   retry,
 	}
 	cw.ctx, cw.cancel = context.WithCancel(channel.Context())
 	cw.logger = logger.WithField("#", cw.Name())
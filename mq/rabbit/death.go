@@ -0,0 +1,77 @@
+package rabbit
+
+import (
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// XDeath is one entry of the x-death header the broker maintains every time
+// a message is dead-lettered, one entry per queue and reason.
+type XDeath struct {
+	Reason      string
+	Queue       string
+	Exchange    string
+	RoutingKeys []string
+	Time        time.Time
+	Count       int64
+}
+
+type XDeaths []XDeath
+
+// Count sums up how many times the message died in queue, for any reason.
+func (ds XDeaths) Count(queue string) int64 {
+	var count int64
+	for _, d := range ds {
+		if d.Queue == queue {
+			count += d.Count
+		}
+	}
+	return count
+}
+
+// Of returns the entries of queue, most recent first as the broker keeps them.
+func (ds XDeaths) Of(queue string) XDeaths {
+	var of XDeaths
+	for _, d := range ds {
+		if d.Queue == queue {
+			of = append(of, d)
+		}
+	}
+	return of
+}
+
+// ParseXDeaths reads the x-death header, anything unexpected is skipped.
+func ParseXDeaths(headers amqp.Table) XDeaths {
+	entries, _ := headers["x-death"].([]interface{})
+	deaths := make(XDeaths, 0, len(entries))
+	for _, entry := range entries {
+		table, ok := entry.(amqp.Table)
+		if !ok {
+			continue
+		}
+		d := XDeath{}
+		d.Reason, _ = table["reason"].(string)
+		d.Queue, _ = table["queue"].(string)
+		d.Exchange, _ = table["exchange"].(string)
+		d.Time, _ = table["time"].(time.Time)
+		switch count := table["count"].(type) {
+		case int64:
+			d.Count = count
+		case int32:
+			d.Count = int64(count)
+		case int16:
+			d.Count = int64(count)
+		case int8:
+			d.Count = int64(count)
+		}
+		keys, _ := table["routing-keys"].([]interface{})
+		for _, key := range keys {
+			if k, ok := key.(string); ok {
+				d.RoutingKeys = append(d.RoutingKeys, k)
+			}
+		}
+		deaths = append(deaths, d)
+	}
+	return deaths
+}
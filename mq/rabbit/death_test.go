@@ -0,0 +1,80 @@
+package rabbit
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestParseXDeaths(t *testing.T) {
+	at := time.Date(2023, 5, 4, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		deaths  XDeaths
+		// counts are what Count and Of tell per queue
+		counts map[string]int64
+	}{
+		{name: "no header", headers: amqp.Table{}, deaths: XDeaths{},
+			counts: map[string]int64{"work": 0}},
+		{name: "not a list", headers: amqp.Table{"x-death": "work"}, deaths: XDeaths{}},
+		{name: "not a table", headers: amqp.Table{"x-death": []interface{}{"work", 3}}, deaths: XDeaths{}},
+		{name: "one entry", headers: amqp.Table{"x-death": []interface{}{
+			amqp.Table{"reason": "rejected", "queue": "work", "exchange": "events", "time": at,
+				"count": int64(2), "routing-keys": []interface{}{"orders.created"}},
+		}}, deaths: XDeaths{
+			{Reason: "rejected", Queue: "work", Exchange: "events", Time: at, Count: 2,
+				RoutingKeys: []string{"orders.created"}},
+		}, counts: map[string]int64{"work": 2, "other": 0}},
+		{name: "several queues", headers: amqp.Table{"x-death": []interface{}{
+			amqp.Table{"reason": "expired", "queue": "work.wait", "count": int32(1)},
+			amqp.Table{"reason": "rejected", "queue": "work", "count": int32(3)},
+			"garbage",
+			amqp.Table{"reason": "expired", "queue": "work", "count": int64(2)},
+		}}, deaths: XDeaths{
+			{Reason: "expired", Queue: "work.wait", Count: 1},
+			{Reason: "rejected", Queue: "work", Count: 3},
+			{Reason: "expired", Queue: "work", Count: 2},
+		}, counts: map[string]int64{"work": 5, "work.wait": 1}},
+		{name: "malformed fields", headers: amqp.Table{"x-death": []interface{}{
+			amqp.Table{"reason": 1, "queue": "work", "count": "3", "time": "now",
+				"routing-keys": []interface{}{"a", 2, "b"}},
+		}}, deaths: XDeaths{
+			{Queue: "work", RoutingKeys: []string{"a", "b"}},
+		}, counts: map[string]int64{"work": 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deaths := ParseXDeaths(test.headers)
+			if !reflect.DeepEqual(deaths, test.deaths) {
+				t.Fatalf("expected %+v, got %+v", test.deaths, deaths)
+			}
+			for queue, count := range test.counts {
+				if c := deaths.Count(queue); c != count {
+					t.Errorf("%s: expected count %d, got %d", queue, count, c)
+				}
+				for _, d := range deaths.Of(queue) {
+					if d.Queue != queue {
+						t.Errorf("%s: got an entry of %s", queue, d.Queue)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestXDeathsOfKeepsOrder(t *testing.T) {
+	deaths := XDeaths{
+		{Reason: "expired", Queue: "work"},
+		{Reason: "rejected", Queue: "other"},
+		{Reason: "rejected", Queue: "work"},
+	}
+	if of := deaths.Of("work"); len(of) != 2 || of[0].Reason != "expired" || of[1].Reason != "rejected" {
+		t.Fatalf("unexpected %+v", of)
+	}
+	if of := deaths.Of("missing"); len(of) != 0 {
+		t.Fatalf("unexpected %+v", of)
+	}
+}
@@ -0,0 +1,89 @@
+package rabbit
+
+import (
+	"context"
+	"time"
+
+	"github.com/s4mli/bolsa/mq"
+	"github.com/streadway/amqp"
+)
+
+// Delivery is what a Handler gets, acknowledging is left to the worker.
+type Delivery struct {
+	Headers         amqp.Table
+	Body            []byte
+	Exchange        string
+	RoutingKey      string
+	Redelivered     bool
+	ConsumerTag     string
+	DeliveryTag     uint64
+	ContentType     string
+	ContentEncoding string
+	DeliveryMode    uint8
+	Priority        uint8
+	CorrelationId   string
+	ReplyTo         string
+	Expiration      string
+	MessageId       string
+	Timestamp       time.Time
+	Type            string
+	UserId          string
+	AppId           string
+	Deaths          XDeaths
+}
+
+func newDelivery(m amqp.Delivery) *Delivery {
+	return &Delivery{
+		Headers:         m.Headers,
+		Body:            m.Body,
+		Exchange:        m.Exchange,
+		RoutingKey:      m.RoutingKey,
+		Redelivered:     m.Redelivered,
+		ConsumerTag:     m.ConsumerTag,
+		DeliveryTag:     m.DeliveryTag,
+		ContentType:     m.ContentType,
+		ContentEncoding: m.ContentEncoding,
+		DeliveryMode:    m.DeliveryMode,
+		Priority:        m.Priority,
+		CorrelationId:   m.CorrelationId,
+		ReplyTo:         m.ReplyTo,
+		Expiration:      m.Expiration,
+		MessageId:       m.MessageId,
+		Timestamp:       m.Timestamp,
+		Type:            m.Type,
+		UserId:          m.UserId,
+		AppId:           m.AppId,
+		Deaths:          ParseXDeaths(m.Headers),
+	}
+}
+
+// Handler is called for every delivery of the queue, its context being
+// cancelled as the consumer stops.
+type Handler func(context.Context, *Delivery) error
+
+func (h Handler) handle(ctx context.Context, d *Delivery) error { return h(ctx, d) }
+
+// WithTimeout cancels the context of each call after timeout, the delivery
+// is settled by whatever h returns all the same.
+func (h Handler) WithTimeout(timeout time.Duration) Handler {
+	return func(ctx context.Context, d *Delivery) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return h(ctx, d)
+	}
+}
+
+// OnPanic settles a delivery with action when h panics, instead of
+// rejecting it to the dead letter exchange of the queue.
+func (h Handler) OnPanic(action mq.Action) Handler {
+	return func(ctx context.Context, d *Delivery) error {
+		return mq.Recovered(action, func() error { return h(ctx, d) })
+	}
+}
+
+type MessageHandler func(amqp.Table, []byte) error
+
+// Handler adapts the plain signature, it never sees the context.
+func (mh MessageHandler) Handler() Handler {
+	return func(_ context.Context, d *Delivery) error { return mh(d.Headers, d.Body) }
+}
@@ -4,6 +4,7 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/s4mli/bolsa/cleaner"
+	"github.com/streadway/amqp"
 )
 
 type Medium interface {
@@ -16,7 +17,39 @@ type Medium interface {
 	Clean()
 }
 
+type Outcome int
+
+const (
+	Confirmed Outcome = iota
+	Nacked
+	Returned
+	Failed
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Confirmed:
+		return "confirmed"
+	case Nacked:
+		return "nacked"
+	case Returned:
+		return "returned"
+	default:
+		return "failed"
+	}
+}
+
+// OnPublished is called once per message with its final outcome, after
+// retries are exhausted for nacked or failed ones. It runs on the confirm
+// loop of the worker, a blocking one stalls publishing once 128
+// publishings wait to be confirmed.
+type OnPublished func(exchange, topic string, message amqp.Publishing, outcome Outcome, failed error)
+
 type Publisher interface {
 	Publish(exchange, topic string, data []byte)
+	PublishMessage(exchange, topic string, message amqp.Publishing)
 	PublishJson(exchange, topic string, data interface{}) error
+	// PublishJsonMessage marshals data into the body of message, content type
+	// defaults to application/json and delivery mode to persistent.
+	PublishJsonMessage(exchange, topic string, data interface{}, message amqp.Publishing) error
 }
@@ -0,0 +1,60 @@
+package rabbit
+
+import (
+	"sort"
+	"time"
+)
+
+const defaultConfirmTimeout = 5 * time.Second
+
+// PublisherOptions tunes what publishers do besides publishing. Topology is
+// declared on every fresh channel. A message not confirmed within
+// ConfirmTimeout (5s by default) counts as failed, nacked or failed ones are
+// published again up to RetryLimit times before OnPublished hears about them.
+// Publishing is at least once then, a confirm arriving after the timeout is
+// only logged as untracked, the broker may well hold the message twice.
+type PublisherOptions struct {
+	Topology       *Topology     `yaml:"topology"`
+	ConfirmTimeout time.Duration `yaml:"confirmTimeout"`
+	RetryLimit     int           `yaml:"retryLimit"`
+	OnPublished    OnPublished   `yaml:"-"`
+}
+
+func (o PublisherOptions) withDefaults() PublisherOptions {
+	if o.ConfirmTimeout <= 0 {
+		o.ConfirmTimeout = defaultConfirmTimeout
+	}
+	if o.RetryLimit < 0 {
+		o.RetryLimit = 0
+	}
+	return o
+}
+
+// ConsumerOptions tunes what consumers do besides handling. Topology is
+// declared on every fresh channel. With Delays failures go through wait
+// queues, one per delay from the shortest, the last one reused once they run
+// out, otherwise they are rejected to the dead letter exchange of the queue.
+// Either way a message retried RetryLimit times (0 for no limit) goes to
+// RetryLimitReached instead of the handler.
+type ConsumerOptions struct {
+	Topology          *Topology         `yaml:"topology"`
+	RetryLimit        int               `yaml:"retryLimit"`
+	Delays            []time.Duration   `yaml:"delays"`
+	RetryLimitReached RetryLimitReached `yaml:"-"`
+}
+
+// withDefaults keeps the positive delays, shortest first.
+func (o ConsumerOptions) withDefaults() ConsumerOptions {
+	if o.RetryLimit < 0 {
+		o.RetryLimit = 0
+	}
+	var delays []time.Duration
+	for _, d := range o.Delays {
+		if d > 0 {
+			delays = append(delays, d)
+		}
+	}
+	sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+	o.Delays = delays
+	return o
+}
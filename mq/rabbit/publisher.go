@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 
 	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
 	"golang.org/x/net/context"
 )
 
@@ -14,25 +15,45 @@ type publisher struct {
 }
 
 func (p *publisher) Publish(exchange, topic string, data []byte) {
-	p.contentCh <- content{exchange, topic, data}
+	p.PublishMessage(exchange, topic, amqp.Publishing{
+		ContentType: "text/plain",
+		Body:        data,
+	})
+}
+
+func (p *publisher) PublishMessage(exchange, topic string, message amqp.Publishing) {
+	p.contentCh <- content{exchange: exchange, topic: topic, message: message}
 }
 
 func (p *publisher) PublishJson(exchange, topic string, data interface{}) error {
+	return p.PublishJsonMessage(exchange, topic, data, amqp.Publishing{})
+}
+
+func (p *publisher) PublishJsonMessage(exchange, topic string, data interface{}, message amqp.Publishing) error {
 	if body, err := json.Marshal(data); err != nil {
 		return err
 	} else {
-		p.Publish(exchange, topic, body)
+		if message.ContentType == "" {
+			message.ContentType = "application/json"
+		}
+		if message.DeliveryMode == 0 {
+			message.DeliveryMode = amqp.Persistent
+		}
+		message.Body = body
+		p.PublishMessage(exchange, topic, message)
 		return nil
 	}
 }
 
 func RunPublisher(
 	ctx context.Context,
-	uri, user, password string,
+	config Config,
 	prefetchCount, prefetchSize, count int,
+	options PublisherOptions,
 	logger logrus.FieldLogger,
 ) Publisher {
-	connection, contentCh := NewConnection(ctx, uri, user, password, logger), make(chan content, count)
+	options = options.withDefaults()
+	connection, contentCh := NewConnection(ctx, config, logger), make(chan content, count)
 	p := &publisher{
 		connection: connection,
 		contentCh:  contentCh,
@@ -40,8 +61,8 @@ func RunPublisher(
 			workers := make(map[int]*publisherWorker, count)
 			for id := 0; id < count; id++ {
 				workers[id] = newPublisherWorker(
-					NewChannel(id+1, connection, prefetchCount, prefetchSize, logger),
-					id+1, logger,
+					NewChannel(id+1, connection, prefetchCount, prefetchSize, options.Topology, logger),
+					id+1, options, logger,
 				).run(contentCh)
 			}
 			return workers
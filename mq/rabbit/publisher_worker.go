@@ -4,33 +4,201 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
 )
 
+// confirmBuffer bounds the unconfirmed publishings of a channel, the
+// confirm and return listeners must hold all of them or the connection
+// blocks, no more is taken from contentCh until some are confirmed.
+const confirmBuffer = 128
+
+var (
+	errNacked         = fmt.Errorf("nacked")
+	errConfirmTimeout = fmt.Errorf("confirm timeout")
+	errTerminated     = fmt.Errorf("channel terminated")
+	errStopped        = fmt.Errorf("stopped")
+)
+
 type publisherWorker struct {
-	ctx     context.Context
-	cancel  context.CancelFunc
-	channel *Channel
-	id      int
-	logger  logrus.FieldLogger
+	ctx            context.Context
+	cancel         context.CancelFunc
+	channel        *Channel
+	id             int
+	confirmTimeout time.Duration
+	retryLimit     int
+	contentCh      chan content
+	published      OnPublished
+	logger         logrus.FieldLogger
 }
 
 type content struct {
 	exchange string
 	topic    string
-	data     []byte
+	message  amqp.Publishing
+	attempts int
+}
+
+func (c content) String() string {
+	return fmt.Sprintf("(%s,%s)(%s)", c.exchange, c.topic, strings.Replace(
+		string(c.message.Body), "\"", "", -1))
+}
+
+type unconfirmed struct {
+	content
+	publishedAt time.Time
+	returned    *amqp.Return
+}
+
+// delivery tags are scoped to a channel and restart from 1 on every fresh
+// channel, so a tracker lives exactly as long as one established channel.
+type confirmTracker struct {
+	sync.Mutex
+	tag     uint64
+	pending map[uint64]*unconfirmed
+}
+
+func (t *confirmTracker) track(c content) uint64 {
+	t.Lock()
+	defer t.Unlock()
+	t.tag++
+	t.pending[t.tag] = &unconfirmed{content: c, publishedAt: time.Now()}
+	return t.tag
+}
+
+func (t *confirmTracker) untrack(tag uint64) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.pending, tag)
+	t.tag--
+}
+
+func (t *confirmTracker) resolve(tag uint64) (*unconfirmed, bool) {
+	t.Lock()
+	defer t.Unlock()
+	u, ok := t.pending[tag]
+	delete(t.pending, tag)
+	return u, ok
+}
+
+// with mandatory set, an unroutable message is returned before it is acked,
+// returns carry no delivery tag so match the oldest unconfirmed publishing.
+func (t *confirmTracker) markReturned(returned amqp.Return) bool {
+	t.Lock()
+	defer t.Unlock()
+	var found uint64
+	for tag, u := range t.pending {
+		if u.returned == nil && (found == 0 || tag < found) &&
+			u.exchange == returned.Exchange && u.topic == returned.RoutingKey &&
+			u.message.MessageId == returned.MessageId &&
+			string(u.message.Body) == string(returned.Body) {
+			found = tag
+		}
+	}
+	if found != 0 {
+		t.pending[found].returned = &returned
+	}
+	return found != 0
+}
+
+func (t *confirmTracker) expired(timeout time.Duration) []*unconfirmed {
+	t.Lock()
+	defer t.Unlock()
+	var expired []*unconfirmed
+	for tag, u := range t.pending {
+		if time.Since(u.publishedAt) > timeout {
+			expired = append(expired, u)
+			delete(t.pending, tag)
+		}
+	}
+	return expired
+}
+
+func (t *confirmTracker) drain() []*unconfirmed {
+	t.Lock()
+	defer t.Unlock()
+	var all []*unconfirmed
+	for tag, u := range t.pending {
+		all = append(all, u)
+		delete(t.pending, tag)
+	}
+	return all
+}
+
+func (t *confirmTracker) size() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.pending)
+}
+
+func newConfirmTracker() *confirmTracker {
+	return &confirmTracker{pending: make(map[uint64]*unconfirmed)}
 }
 
 func (w *publisherWorker) Name() string { return fmt.Sprintf("P(%05d)", w.id) }
-func (w *publisherWorker) doPublish(contentCh <-chan content) {
+func (w *publisherWorker) report(c content, outcome Outcome, failed error) {
+	if w.published != nil {
+		w.published(c.exchange, c.topic, c.message, outcome, failed)
+	}
+}
+
+func (w *publisherWorker) retry(c content, outcome Outcome, failed error) {
+	if c.attempts < w.retryLimit {
+		c.attempts++
+		w.logger.WithFields(logrus.Fields{
+			"&": "Retry",
+			"*": c.String(),
+		}).Warnf("=> Retry(%d) %s", c.attempts, failed)
+		go func() {
+			select {
+			case w.contentCh <- c:
+			case <-w.ctx.Done():
+				w.logger.WithFields(logrus.Fields{
+					"&": "Retry",
+					"*": c.String(),
+				}).Error("=> Failed: stopped before retry, ", failed)
+				w.report(c, outcome, failed)
+			}
+		}()
+	} else {
+		w.logger.WithFields(logrus.Fields{
+			"&": "Retry",
+			"*": c.String(),
+		}).Errorf("=> Failed: %s after %d attempts", failed, c.attempts+1)
+		w.report(c, outcome, failed)
+	}
+}
+
+// drain reports whatever is still buffered once stopped, it will never be
+// published, every worker drains the shared contentCh until it's empty.
+func (w *publisherWorker) drain() {
+	for {
+		select {
+		case c := <-w.contentCh:
+			w.logger.WithFields(logrus.Fields{
+				"&": "Stop",
+				"*": c.String(),
+			}).Error("=> Failed: stopped before publish")
+			w.report(c, Failed, errStopped)
+		default:
+			return
+		}
+	}
+}
+
+func (w *publisherWorker) doPublish(contentCh <-chan content, tracker *confirmTracker) {
 	key := w.Name() + "_publish"
 	w.logger.WithField("&", "Publish").Debug("=> Register " + key)
 	_, terminated, teared := w.channel.Accept(key)
 	go func() {
 		for {
+			input := contentCh
+			if tracker.size() >= confirmBuffer {
+				input = nil
+			}
 			select {
 			case <-w.ctx.Done():
 				w.logger.WithField("&", "PublishStop").Info("=> Teared")
@@ -53,26 +221,35 @@ func (w *publisherWorker) doPublish(contentCh <-chan content) {
 				w.channel.Remove(key)
 				w.logger.WithField("&", "PublishTerminate").Info("=> Terminated")
 				return
-			case c := <-contentCh:
-				logBody := fmt.Sprintf("(%s,%s)(%s)", c.exchange, c.topic, strings.Replace(
-					string(c.data), "\"", "", -1))
+			case c := <-input:
+				if w.ctx.Err() != nil {
+					w.logger.WithFields(logrus.Fields{
+						"&": "Publish",
+						"*": c.String(),
+					}).Error("=> Failed: stopped before publish")
+					w.report(c, Failed, errStopped)
+					continue
+				}
+				/*
+					track before publishing, the ack may arrive before Publish returns
+				*/
+				tag := tracker.track(c)
 				if err := w.channel.Publish(
 					c.exchange,
 					c.topic,
 					true,
 					false,
-					amqp.Publishing{
-						ContentType: "text/plain",
-						Body:        c.data,
-					}); err != nil {
+					c.message); err != nil {
+					tracker.untrack(tag)
 					w.logger.WithFields(logrus.Fields{
 						"&": "Publish",
-						"*": logBody,
+						"*": c.String(),
 					}).Error("=> Publish failed:", err)
+					w.retry(c, Failed, err)
 				} else {
 					w.logger.WithFields(logrus.Fields{
 						"&": "Publish",
-					}).Info("=> Published: ", logBody)
+					}).Info("=> Published: ", fmt.Sprintf("%05d", tag), c.String())
 				}
 			default:
 				time.Sleep(50 * time.Millisecond)
@@ -81,28 +258,65 @@ func (w *publisherWorker) doPublish(contentCh <-chan content) {
 	}()
 }
 
-func (w *publisherWorker) doConfirm(confirmCh chan amqp.Confirmation, returnCh chan amqp.Return) {
+func (w *publisherWorker) doConfirm(
+	tracker *confirmTracker,
+	confirmCh chan amqp.Confirmation,
+	returnCh chan amqp.Return,
+) {
 	key := w.Name() + "_confirm"
 	w.logger.WithField("&", "Confirm").Debug("=> Register " + key)
 	_, terminated, teared := w.channel.Accept(key)
-	handleConfirmed, handleReturned :=
-		func(confirmed amqp.Confirmation) bool {
-			if 0 == confirmed.DeliveryTag {
-				w.logger.WithField("&", "Confirm").Warn("=> Confirmed: 0 ?")
-			} else {
-				w.logger.WithField("&", "Confirm").Debug("=> Confirmed: ",
-					fmt.Sprintf("%05d", confirmed.DeliveryTag))
+	handleReturned := func(returned amqp.Return) {
+		w.logger.WithFields(logrus.Fields{
+			"&": "Confirm",
+			"*": fmt.Sprintf("(%s,%s)(%d:%s)", returned.Exchange, returned.RoutingKey,
+				returned.ReplyCode, returned.ReplyText),
+		}).Error("=> Returned: ", strings.Replace(string(returned.Body), "\"", "", -1))
+		if !tracker.markReturned(returned) {
+			w.logger.WithField("&", "Confirm").Warn("=> Returned: untracked")
+		}
+	}
+	drainReturned := func() {
+		for {
+			select {
+			case returned, ok := <-returnCh:
+				if !ok {
+					return
+				}
+				handleReturned(returned)
+			default:
+				return
 			}
-			return 0 != confirmed.DeliveryTag
-		},
-		func(returned amqp.Return) bool {
+		}
+	}
+	handleConfirmed := func(confirmed amqp.Confirmation) {
+		/*
+			a return is always delivered ahead of the ack of the same message
+		*/
+		drainReturned()
+		if u, ok := tracker.resolve(confirmed.DeliveryTag); !ok {
+			w.logger.WithField("&", "Confirm").Warn("=> Confirmed: untracked ",
+				fmt.Sprintf("%05d", confirmed.DeliveryTag))
+		} else if !confirmed.Ack {
+			w.retry(u.content, Nacked, errNacked)
+		} else if u.returned != nil {
 			w.logger.WithFields(logrus.Fields{
 				"&": "Confirm",
-				"*": fmt.Sprintf("(%s,%s)(%d:%s)", returned.Exchange, returned.RoutingKey,
-					returned.ReplyCode, returned.ReplyText),
-			}).Error("=> Returned: ", strings.Replace(string(returned.Body), "\"", "", -1))
-			return 0 != returned.ReplyCode
+				"*": u.String(),
+			}).Errorf("=> Failed: unroutable(%d:%s)", u.returned.ReplyCode, u.returned.ReplyText)
+			w.report(u.content, Returned, fmt.Errorf("unroutable(%d:%s)",
+				u.returned.ReplyCode, u.returned.ReplyText))
+		} else {
+			w.logger.WithField("&", "Confirm").Debug("=> Confirmed: ",
+				fmt.Sprintf("%05d", confirmed.DeliveryTag))
+			w.report(u.content, Confirmed, nil)
 		}
+	}
+	handleExpired := func() {
+		for _, u := range tracker.expired(w.confirmTimeout) {
+			w.retry(u.content, Failed, errConfirmTimeout)
+		}
+	}
 	/*
 		The listener chan will be closed when the Channel is closed.
 
@@ -114,11 +328,53 @@ func (w *publisherWorker) doConfirm(confirmCh chan amqp.Confirmation, returnCh c
 		It's advisable to wait for all Confirmations to arrive before calling
 		Channel.Close() or Connection.Close().
 	*/
+	keepDraining := func() {
+		go func() {
+			for range confirmCh {
+			}
+		}()
+		go func() {
+			for range returnCh {
+			}
+		}()
+	}
 
 	go func() {
+		ticker := time.NewTicker(w.confirmTimeout / 2)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-w.ctx.Done():
+				/*
+					wait for outstanding confirms before the channel gets closed,
+					keep receiving so the connection never blocks on our listeners.
+				*/
+				w.logger.WithField("&", "ConfirmStop").Infof("=> Await %d confirms", tracker.size())
+				deadline := time.After(w.confirmTimeout)
+			await:
+				for tracker.size() > 0 {
+					select {
+					case confirmed, ok := <-confirmCh:
+						if !ok {
+							break await
+						}
+						handleConfirmed(confirmed)
+					case returned, ok := <-returnCh:
+						if ok {
+							handleReturned(returned)
+						}
+					case <-deadline:
+						break await
+					}
+				}
+				for _, u := range tracker.drain() {
+					w.logger.WithFields(logrus.Fields{
+						"&": "ConfirmStop",
+						"*": u.String(),
+					}).Error("=> Failed: unconfirmed on stop")
+					w.report(u.content, Failed, errStopped)
+				}
+				keepDraining()
 				w.logger.WithField("&", "ConfirmStop").Info("=> Teared")
 				w.channel.tearDown(teared)
 				w.logger.WithField("&", "ConfirmStop").Info("=> Stopped")
@@ -127,27 +383,36 @@ func (w *publisherWorker) doConfirm(confirmCh chan amqp.Confirmation, returnCh c
 				/*
 					channel terminated, then stop confirming,
 					wait for a complete fresh restart(established),
-					everything should be still in contentCh.
+					whatever still unconfirmed will never be, publish them again.
 				*/
 				w.logger.WithField("&", "ConfirmTerminate").Debug("=> Received channel terminated")
+				for _, u := range tracker.drain() {
+					w.retry(u.content, Failed, errTerminated)
+				}
+				keepDraining()
 				w.logger.WithField("&", "ConfirmTerminate").Info("=> Teared")
 				w.channel.tearDown(teared)
 				w.logger.WithField("&", "ConfirmTerminate").Debug("=> Deregister " + key)
 				w.channel.Remove(key)
 				w.logger.WithField("&", "ConfirmTerminate").Info("=> Terminated")
 				return
-			case confirmed := <-confirmCh:
-				handleConfirmed(confirmed)
-			case returned := <-returnCh:
-				handleReturned(returned)
-			default:
-				time.Sleep(50 * time.Millisecond)
+			case confirmed, ok := <-confirmCh:
+				if ok {
+					handleConfirmed(confirmed)
+				}
+			case returned, ok := <-returnCh:
+				if ok {
+					handleReturned(returned)
+				}
+			case <-ticker.C:
+				handleExpired()
 			}
 		}
 	}()
 }
 
 func (w *publisherWorker) run(contentCh chan content) *publisherWorker {
+	w.contentCh = contentCh
 	key := w.Name()
 	w.logger.WithField("&", "Run").Debug("=> Register " + key)
 	established, terminated, teared := w.channel.Accept(key)
@@ -156,12 +421,13 @@ func (w *publisherWorker) run(contentCh chan content) *publisherWorker {
 			select {
 			case <-w.ctx.Done():
 				w.cancel()
-				if w.channel != nil {
+				if w.channel.Channel != nil {
 					w.logger.WithField("&", "Stop").Debug("=> Cancel")
 					if err := w.channel.Cancel(w.Name(), false); err != nil {
 						w.logger.WithField("&", "Stop").Error("=> Cancel failed: ", err)
 					}
 				}
+				w.drain()
 				w.logger.WithField("&", "Stop").Info("=> Teared")
 				w.channel.tearDown(teared)
 				w.logger.WithField("&", "Stop").Info("=> Stopped")
@@ -177,19 +443,19 @@ func (w *publisherWorker) run(contentCh chan content) *publisherWorker {
 				w.logger.WithField("&", "Terminate").Debug("=> Still alive")
 			case <-established:
 				w.logger.WithField("&", "Run").Info("=> Established")
-				//w.logger.WithField("&", "Run").Debug(" => Confirm")
-				//if err := w.channel.Confirm(false); err != nil {
-				//	w.logger.WithField("&", "Run").Error("=> Confirm failed: ", err)
-				//} else {
-				{
-					w.logger.WithField("&", "Run").Debug(" => DoPublish")
-					w.doPublish(contentCh)
-					// TODO: confirm mode doesn't work, ctrl+c will cause channel.publish hang
-					//w.logger.WithField("&", "Run").Debug(" => DoConfirm")
-					//w.doConfirm(
-					//	w.channel.NotifyPublish(make(chan amqp.Confirmation, 1)),
-					//	w.channel.NotifyReturn(make(chan amqp.Return, 1)),
-					//)
+				w.logger.WithField("&", "Run").Debug("=> Confirm")
+				if err := w.channel.Confirm(false); err != nil {
+					w.logger.WithField("&", "Run").Error("=> Confirm failed: ", err)
+				} else {
+					tracker := newConfirmTracker()
+					w.logger.WithField("&", "Run").Debug("=> DoConfirm")
+					w.doConfirm(
+						tracker,
+						w.channel.NotifyPublish(make(chan amqp.Confirmation, confirmBuffer)),
+						w.channel.NotifyReturn(make(chan amqp.Return, confirmBuffer)),
+					)
+					w.logger.WithField("&", "Run").Debug("=> DoPublish")
+					w.doPublish(contentCh, tracker)
 				}
 			default:
 				time.Sleep(50 * time.Millisecond)
@@ -203,11 +469,15 @@ func (w *publisherWorker) run(contentCh chan content) *publisherWorker {
 func newPublisherWorker(
 	channel *Channel,
 	id int,
+	options PublisherOptions,
 	logger logrus.FieldLogger,
 ) *publisherWorker {
 	pw := &publisherWorker{
-		channel: channel,
-		id:      id,
+		channel:        channel,
+		id:             id,
+		confirmTimeout: options.ConfirmTimeout,
+		retryLimit:     options.RetryLimit,
+		published:      options.OnPublished,
 	}
 	pw.ctx, pw.cancel = context.WithCancel(channel.Context())
 	pw.logger = logger.WithField("#", pw.Name())
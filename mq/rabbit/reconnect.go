@@ -0,0 +1,99 @@
+package rabbit
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+type ConnectionState int32
+
+const (
+	Disconnected ConnectionState = iota
+	Connecting
+	Connected
+	GaveUp
+	Closed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case GaveUp:
+		return "gave up"
+	case Closed:
+		return "closed"
+	default:
+		return "disconnected"
+	}
+}
+
+// OnConnectionState is called on every state change and on every failed dial
+// attempt (state Connecting with a non nil err), it must not block.
+type OnConnectionState func(state ConnectionState, attempt int, err error)
+
+// ReconnectPolicy drives dialing both at start and after the connection
+// dropped, the delay between attempts grows exponentially from Initial up
+// to Max, randomized by +/- Jitter (0..1, negative for none). MaxAttempts 0
+// keeps trying forever. Endpoints are tried in the given order unless
+// Shuffle is set. Zero fields take DefaultReconnectPolicy's.
+type ReconnectPolicy struct {
+	Initial     time.Duration     `yaml:"initial"`
+	Max         time.Duration     `yaml:"max"`
+	Multiplier  float64           `yaml:"multiplier"`
+	Jitter      float64           `yaml:"jitter"`
+	MaxAttempts int               `yaml:"maxAttempts"`
+	Shuffle     bool              `yaml:"shuffle"`
+	OnState     OnConnectionState `yaml:"-"`
+}
+
+var DefaultReconnectPolicy = ReconnectPolicy{
+	Initial:    500 * time.Millisecond,
+	Max:        30 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+func (p ReconnectPolicy) withDefaults() ReconnectPolicy {
+	if p.Initial <= 0 {
+		p.Initial = DefaultReconnectPolicy.Initial
+	}
+	if p.Max <= 0 {
+		p.Max = DefaultReconnectPolicy.Max
+	}
+	if p.Max < p.Initial {
+		p.Max = p.Initial
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = DefaultReconnectPolicy.Multiplier
+	}
+	if p.Jitter == 0 {
+		p.Jitter = DefaultReconnectPolicy.Jitter
+	}
+	return p
+}
+
+func (p *ReconnectPolicy) exhausted(attempt int) bool {
+	return p.MaxAttempts > 0 && attempt >= p.MaxAttempts
+}
+
+// backoff returns the delay before attempt, attempts start from 1.
+func (p *ReconnectPolicy) backoff(attempt int) time.Duration {
+	delay := float64(p.Initial) * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.Max > 0 && delay > float64(p.Max) {
+		delay = float64(p.Max)
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+func (p *ReconnectPolicy) notify(state ConnectionState, attempt int, err error) {
+	if p.OnState != nil {
+		p.OnState(state, attempt, err)
+	}
+}
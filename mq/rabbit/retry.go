@@ -0,0 +1,215 @@
+package rabbit
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	retryCountHeader      = "x-retry-count"
+	retryExchangeHeader   = "x-retry-exchange"
+	retryRoutingKeyHeader = "x-retry-routing-key"
+)
+
+// delayedRetry moves failed messages into per attempt wait queues, each wait
+// queue dead-letters back to the consumer queue once its ttl expires. When
+// the limit is reached the message is parked instead.
+type delayedRetry struct {
+	queue  string
+	delays []time.Duration
+	limit  int
+	rlr    RetryLimitReached
+}
+
+// newDelayedRetry is nil without delays, which are sorted by withDefaults.
+func newDelayedRetry(queue string, options ConsumerOptions) *delayedRetry {
+	if len(options.Delays) == 0 {
+		return nil
+	}
+	return &delayedRetry{
+		queue:  queue,
+		delays: options.Delays,
+		limit:  options.RetryLimit,
+		rlr:    options.RetryLimitReached,
+	}
+}
+
+func (r *delayedRetry) waitQueue(attempt int) (string, time.Duration) {
+	if attempt >= len(r.delays) {
+		attempt = len(r.delays) - 1
+	}
+	return fmt.Sprintf("%s.wait.%s", r.queue, r.delays[attempt]), r.delays[attempt]
+}
+
+// tier picks the shortest wait not below delay, or the longest one.
+func (r *delayedRetry) tier(delay time.Duration) int {
+	for i, d := range r.delays {
+		if d >= delay {
+			return i
+		}
+	}
+	return len(r.delays) - 1
+}
+
+func (r *delayedRetry) parkingQueue() string { return r.queue + ".parking" }
+
+func (r *delayedRetry) queues() []Queue {
+	queues := []Queue{{Name: r.parkingQueue(), Durable: true}}
+	declared := make(map[string]bool, len(r.delays))
+	for attempt := range r.delays {
+		if name, delay := r.waitQueue(attempt); !declared[name] {
+			declared[name] = true
+			queues = append(queues, Queue{
+				Name:    name,
+				Durable: true,
+				Args: amqp.Table{
+					"x-message-ttl":             delay.Milliseconds(),
+					"x-dead-letter-exchange":    "",
+					"x-dead-letter-routing-key": r.queue,
+				},
+			})
+		}
+	}
+	return queues
+}
+
+// deferredQueue holds what is deferred without the built-in retry, each
+// message with a ttl of its own, dead-lettering back to queue once expired.
+// Only the head of a queue expires, a short delay waits behind a longer one.
+func deferredQueue(queue string) Queue {
+	return Queue{
+		Name:    queue + ".deferred",
+		Durable: true,
+		Args: amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue,
+		},
+	}
+}
+
+// republishing is m to publish again, with headers.
+func republishing(m amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     m.ContentType,
+		ContentEncoding: m.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        m.Priority,
+		CorrelationId:   m.CorrelationId,
+		ReplyTo:         m.ReplyTo,
+		MessageId:       m.MessageId,
+		Timestamp:       m.Timestamp,
+		Type:            m.Type,
+		UserId:          m.UserId,
+		AppId:           m.AppId,
+		Body:            m.Body,
+	}
+}
+
+// republish publishes to queue through the default exchange, which is
+// what republisher.publish does on a live channel.
+type republish func(queue string, publishing amqp.Publishing) error
+
+// republisher publishes on a consumer channel in confirm mode, one message
+// at a time, waiting for the broker to take it before the original is acked.
+// Delivery tags count from 1 on every fresh channel, confirms for tags below
+// the current one are leftovers of earlier timeouts.
+type republisher struct {
+	ch       *amqp.Channel
+	confirms <-chan amqp.Confirmation
+	tag      uint64
+	timeout  time.Duration
+}
+
+func newRepublisher(ch *amqp.Channel, timeout time.Duration) (*republisher, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, err
+	}
+	return &republisher{
+		ch:       ch,
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, confirmBuffer)),
+		timeout:  timeout,
+	}, nil
+}
+
+func (r *republisher) publish(queue string, publishing amqp.Publishing) error {
+	if err := r.ch.Publish("", queue, false, false, publishing); err != nil {
+		return err
+	}
+	r.tag++
+	timeout := time.After(r.timeout)
+	for {
+		select {
+		case confirmed, ok := <-r.confirms:
+			if !ok {
+				return errTerminated
+			}
+			if confirmed.DeliveryTag < r.tag {
+				continue
+			}
+			if !confirmed.Ack {
+				return errNacked
+			}
+			return nil
+		case <-timeout:
+			return errConfirmTimeout
+		}
+	}
+}
+
+// deferTo republishes m to the deferred queue of queue, to come back after
+// delay. The caller acks the original only if it succeeds.
+func deferTo(publish republish, queue string, m amqp.Delivery, delay time.Duration) error {
+	publishing := republishing(m, m.Headers)
+	publishing.Expiration = strconv.FormatInt(delay.Milliseconds(), 10)
+	return publish(deferredQueue(queue).Name, publishing)
+}
+
+func (r *delayedRetry) attempts(headers amqp.Table) int {
+	switch count := headers[retryCountHeader].(type) {
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	default:
+		return 0
+	}
+}
+
+// schedule republishes a failed delivery to its next wait queue, or to the
+// wait queue closest to delay when given, or to the parking queue once
+// retries are exhausted. The caller acks the original only if it succeeds.
+func (r *delayedRetry) schedule(publish republish, m amqp.Delivery, delay time.Duration) error {
+	headers := amqp.Table{}
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	if _, ok := headers[retryExchangeHeader]; !ok {
+		headers[retryExchangeHeader] = m.Exchange
+		headers[retryRoutingKeyHeader] = m.RoutingKey
+	}
+	attempt := r.attempts(m.Headers)
+	publishing := republishing(m, headers)
+	if r.limit > 0 && attempt >= r.limit {
+		if err := publish(r.parkingQueue(), publishing); err != nil {
+			return err
+		}
+		if r.rlr != nil {
+			exchange, _ := headers[retryExchangeHeader].(string)
+			routingKey, _ := headers[retryRoutingKeyHeader].(string)
+			r.rlr.handle(exchange, r.queue, []string{routingKey}, ParseXDeaths(m.Headers), m.Body)
+		}
+		return nil
+	} else {
+		headers[retryCountHeader] = int64(attempt + 1)
+		tier := attempt
+		if delay > 0 {
+			tier = r.tier(delay)
+		}
+		queue, _ := r.waitQueue(tier)
+		return publish(queue, publishing)
+	}
+}
@@ -0,0 +1,167 @@
+package rabbit
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestNewDelayedRetry(t *testing.T) {
+	if r := newDelayedRetry("work", ConsumerOptions{}.withDefaults()); r != nil {
+		t.Fatalf("expected no retry without delays, got %+v", r)
+	}
+	if r := newDelayedRetry("work", ConsumerOptions{Delays: []time.Duration{0, -time.Second}}.withDefaults()); r != nil {
+		t.Fatalf("expected no retry without positive delays, got %+v", r)
+	}
+	r := newDelayedRetry("work", ConsumerOptions{
+		RetryLimit: 3,
+		Delays:     []time.Duration{time.Minute, 0, time.Second, 10 * time.Second},
+	}.withDefaults())
+	if expected := []time.Duration{time.Second, 10 * time.Second, time.Minute}; !reflect.DeepEqual(r.delays, expected) {
+		t.Fatalf("expected %v, got %v", expected, r.delays)
+	}
+	if r.limit != 3 || r.queue != "work" {
+		t.Fatalf("unexpected %+v", r)
+	}
+}
+
+func TestWaitQueue(t *testing.T) {
+	r := &delayedRetry{queue: "work", delays: []time.Duration{time.Second, time.Minute}}
+	tests := []struct {
+		attempt int
+		name    string
+		delay   time.Duration
+	}{
+		{0, "work.wait.1s", time.Second},
+		{1, "work.wait.1m0s", time.Minute},
+		{2, "work.wait.1m0s", time.Minute},
+		{10, "work.wait.1m0s", time.Minute},
+	}
+	for _, test := range tests {
+		if name, delay := r.waitQueue(test.attempt); name != test.name || delay != test.delay {
+			t.Errorf("attempt %d: expected %s %s, got %s %s", test.attempt, test.name, test.delay, name, delay)
+		}
+	}
+}
+
+func TestTier(t *testing.T) {
+	r := &delayedRetry{queue: "work", delays: []time.Duration{time.Second, 10 * time.Second, time.Minute}}
+	tests := []struct {
+		delay time.Duration
+		tier  int
+	}{
+		{time.Millisecond, 0},
+		{time.Second, 0},
+		{2 * time.Second, 1},
+		{10 * time.Second, 1},
+		{30 * time.Second, 2},
+		{time.Hour, 2},
+	}
+	for _, test := range tests {
+		if tier := r.tier(test.delay); tier != test.tier {
+			t.Errorf("%s: expected tier %d, got %d", test.delay, test.tier, tier)
+		}
+	}
+}
+
+func TestQueues(t *testing.T) {
+	r := newDelayedRetry("work", ConsumerOptions{
+		Delays: []time.Duration{time.Second, time.Minute, time.Second},
+	}.withDefaults())
+	queues := r.queues()
+	if len(queues) != 3 {
+		t.Fatalf("expected parking and two wait queues, got %+v", queues)
+	}
+	if queues[0].Name != "work.parking" || !queues[0].Durable || queues[0].Args != nil {
+		t.Fatalf("unexpected parking queue %+v", queues[0])
+	}
+	for i, expected := range []struct {
+		name string
+		ttl  int64
+	}{{"work.wait.1s", 1000}, {"work.wait.1m0s", 60000}} {
+		q := queues[i+1]
+		if q.Name != expected.name || !q.Durable || q.Args["x-message-ttl"] != expected.ttl ||
+			q.Args["x-dead-letter-exchange"] != "" || q.Args["x-dead-letter-routing-key"] != "work" {
+			t.Errorf("unexpected wait queue %+v", q)
+		}
+	}
+}
+
+type published struct {
+	queue      string
+	publishing amqp.Publishing
+}
+
+func TestSchedule(t *testing.T) {
+	delays := []time.Duration{time.Second, 10 * time.Second, time.Minute}
+	tests := []struct {
+		name     string
+		limit    int
+		headers  amqp.Table
+		delay    time.Duration
+		queue    string
+		attempts interface{}
+		parked   bool
+	}{
+		{name: "first", limit: 3, queue: "work.wait.1s", attempts: int64(1)},
+		{name: "next", limit: 3, headers: amqp.Table{retryCountHeader: int32(1)},
+			queue: "work.wait.10s", attempts: int64(2)},
+		{name: "past the delays", headers: amqp.Table{retryCountHeader: int64(5)},
+			queue: "work.wait.1m0s", attempts: int64(6)},
+		{name: "asked delay", limit: 3, delay: 5 * time.Second, queue: "work.wait.10s", attempts: int64(1)},
+		{name: "limit reached", limit: 3, headers: amqp.Table{retryCountHeader: int64(3)},
+			queue: "work.parking", attempts: int64(3), parked: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				sent    []published
+				reached []string
+			)
+			r := &delayedRetry{queue: "work", delays: delays, limit: test.limit,
+				rlr: func(exchange, queue string, routeKeys []string, deaths XDeaths, body []byte) {
+					reached = append(append(reached, exchange, queue), routeKeys...)
+				}}
+			m := amqp.Delivery{Exchange: "events", RoutingKey: "orders.created", Headers: test.headers,
+				MessageId: "1", Body: []byte("hi")}
+			if err := r.schedule(func(queue string, publishing amqp.Publishing) error {
+				sent = append(sent, published{queue, publishing})
+				return nil
+			}, m, test.delay); err != nil {
+				t.Fatal(err)
+			}
+			if len(sent) != 1 || sent[0].queue != test.queue {
+				t.Fatalf("expected one publishing to %s, got %+v", test.queue, sent)
+			}
+			p := sent[0].publishing
+			if p.Headers[retryCountHeader] != test.attempts {
+				t.Errorf("expected %v attempts, got %v", test.attempts, p.Headers[retryCountHeader])
+			}
+			if p.Headers[retryExchangeHeader] != "events" || p.Headers[retryRoutingKeyHeader] != "orders.created" ||
+				p.MessageId != "1" || string(p.Body) != "hi" || p.DeliveryMode != amqp.Persistent {
+				t.Errorf("unexpected publishing %+v", p)
+			}
+			if expected := []string{"events", "work", "orders.created"}; test.parked != (reached != nil) ||
+				(test.parked && !reflect.DeepEqual(reached, expected)) {
+				t.Errorf("expected parked %v, got %v", test.parked, reached)
+			}
+		})
+	}
+}
+
+func TestScheduleFailure(t *testing.T) {
+	failed := errors.New("closed")
+	reached := false
+	r := &delayedRetry{queue: "work", delays: []time.Duration{time.Second}, limit: 1,
+		rlr: func(string, string, []string, XDeaths, []byte) { reached = true }}
+	m := amqp.Delivery{Headers: amqp.Table{retryCountHeader: int64(1)}}
+	if err := r.schedule(func(string, amqp.Publishing) error { return failed }, m, 0); !errors.Is(err, failed) {
+		t.Fatalf("expected %v, got %v", failed, err)
+	}
+	if reached {
+		t.Fatal("retry limit reported though parking failed")
+	}
+}
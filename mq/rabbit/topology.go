@@ -0,0 +1,77 @@
+package rabbit
+
+import (
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+type Exchange struct {
+	Name       string
+	Kind       string
+	Durable    bool
+	AutoDelete bool
+	Internal   bool
+	Args       amqp.Table
+}
+
+type Queue struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	Args       amqp.Table
+}
+
+type Binding struct {
+	Queue    string
+	Exchange string
+	Key      string
+	Args     amqp.Table
+}
+
+// Topology is declared on every fresh channel, exchanges first, then queues,
+// then bindings. Declarations are idempotent as long as they don't conflict
+// with what the broker already has, a conflict closes the channel.
+type Topology struct {
+	Exchanges []Exchange
+	Queues    []Queue
+	Bindings  []Binding
+}
+
+func (t *Topology) declare(ch *amqp.Channel) error {
+	if t == nil {
+		return nil
+	}
+	for _, e := range t.Exchanges {
+		kind := e.Kind
+		if kind == "" {
+			kind = amqp.ExchangeTopic
+		}
+		if err := ch.ExchangeDeclare(e.Name, kind, e.Durable, e.AutoDelete, e.Internal,
+			false, e.Args); err != nil {
+			return fmt.Errorf("exchange(%s): %w", e.Name, err)
+		}
+	}
+	for _, q := range t.Queues {
+		if _, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive,
+			false, q.Args); err != nil {
+			return fmt.Errorf("queue(%s): %w", q.Name, err)
+		}
+	}
+	for _, b := range t.Bindings {
+		if err := ch.QueueBind(b.Queue, b.Key, b.Exchange, false, b.Args); err != nil {
+			return fmt.Errorf("binding(%s,%s,%s): %w", b.Exchange, b.Key, b.Queue, err)
+		}
+	}
+	return nil
+}
+
+func (t *Topology) withQueues(queues ...Queue) *Topology {
+	merged := &Topology{}
+	if t != nil {
+		*merged = *t
+	}
+	merged.Queues = append(append([]Queue{}, merged.Queues...), queues...)
+	return merged
+}
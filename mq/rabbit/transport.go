@@ -0,0 +1,135 @@
+package rabbit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/s4mli/bolsa/mq"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+func init() {
+	mq.Register("rabbit", func() mq.Transport { return &Transport{} })
+}
+
+// Transport runs rabbit behind the mq interfaces, a destination is an
+// exchange and a source a queue.
+type Transport struct {
+	Connection     Config          `yaml:"connection"`
+	Topology       *Topology       `yaml:"topology"`
+	PrefetchCount  int             `yaml:"prefetchCount"`
+	Workers        int             `yaml:"workers"`
+	RetryLimit     int             `yaml:"retryLimit"`
+	Delays         []time.Duration `yaml:"delays"`
+	ConfirmTimeout time.Duration   `yaml:"confirmTimeout"`
+	PublishRetries int             `yaml:"publishRetries"`
+}
+
+func (t *Transport) workers() int {
+	if t.Workers > 0 {
+		return t.Workers
+	}
+	return 1
+}
+
+func (t *Transport) RunPublisher(
+	ctx context.Context,
+	destination string,
+	published mq.OnPublished,
+	logger logrus.FieldLogger,
+) mq.Publisher {
+	var onPublished OnPublished
+	if published != nil {
+		onPublished = func(exchange, topic string, message amqp.Publishing, outcome Outcome, failed error) {
+			m := fromPublishing(message)
+			m.Topic = topic
+			published(m, failed)
+		}
+	}
+	return &transportPublisher{
+		publisher: RunPublisher(ctx, t.Connection, t.PrefetchCount, 0, t.workers(), PublisherOptions{
+			Topology:       t.Topology,
+			ConfirmTimeout: t.ConfirmTimeout,
+			RetryLimit:     t.PublishRetries,
+			OnPublished:    onPublished,
+		}, logger),
+		exchange: destination,
+	}
+}
+
+func (t *Transport) RunConsumer(
+	ctx context.Context,
+	source string,
+	handler mq.Handler,
+	logger logrus.FieldLogger,
+) mq.Consumer {
+	return RunConsumer(ctx, t.Connection, source, t.PrefetchCount, 0, t.workers(),
+		func(ctx context.Context, d *Delivery) error {
+			return handler(ctx, d.MQ())
+		}, ConsumerOptions{
+			Topology:   t.Topology,
+			RetryLimit: t.RetryLimit,
+			Delays:     t.Delays,
+		}, logger)
+}
+
+type transportPublisher struct {
+	publisher Publisher
+	exchange  string
+}
+
+func (p *transportPublisher) Publish(m *mq.Message) error {
+	headers := make(amqp.Table, len(m.Attributes))
+	for k, v := range m.Attributes {
+		headers[k] = v
+	}
+	p.publisher.PublishMessage(p.exchange, m.Topic, amqp.Publishing{
+		Headers:     headers,
+		ContentType: m.ContentType,
+		MessageId:   m.Id,
+		Timestamp:   m.Timestamp,
+		Body:        m.Body,
+	})
+	return nil
+}
+
+func (p *transportPublisher) PublishJson(topic string, v interface{}) error {
+	return p.publisher.PublishJson(p.exchange, topic, v)
+}
+
+func attributes(headers amqp.Table) map[string]string {
+	attributes := make(map[string]string, len(headers))
+	for k, v := range headers {
+		if s, ok := v.(string); ok {
+			attributes[k] = s
+		} else {
+			attributes[k] = fmt.Sprint(v)
+		}
+	}
+	return attributes
+}
+
+func fromPublishing(p amqp.Publishing) *mq.Message {
+	return &mq.Message{
+		Id:          p.MessageId,
+		ContentType: p.ContentType,
+		Attributes:  attributes(p.Headers),
+		Body:        p.Body,
+		Timestamp:   p.Timestamp,
+	}
+}
+
+// MQ is the transport neutral view of d.
+func (d *Delivery) MQ() *mq.Message {
+	return &mq.Message{
+		Id:          d.MessageId,
+		Topic:       d.RoutingKey,
+		ContentType: d.ContentType,
+		Attributes:  attributes(d.Headers),
+		Body:        d.Body,
+		Redelivered: d.Redelivered,
+		Timestamp:   d.Timestamp,
+	}
+}
@@ -2,10 +2,14 @@ package snsqs
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/s4mli/bolsa/cleaner"
 	"github.com/sirupsen/logrus"
@@ -13,14 +17,60 @@ import (
 
 // message from sns to sqs
 type SNSMessage struct {
-	Message        string `json:"Message"`
-	TopicArn       string `json:"TopicArn"`
-	MessageId      string `json:"MessageId"`
-	UnsubscribeURL string `json:"UnsubscribeURL"`
+	Type              string                         `json:"Type"`
+	MessageId         string                         `json:"MessageId"`
+	TopicArn          string                         `json:"TopicArn"`
+	Subject           string                         `json:"Subject,omitempty"`
+	Message           string                         `json:"Message"`
+	Timestamp         time.Time                      `json:"Timestamp"`
+	SignatureVersion  string                         `json:"SignatureVersion"`
+	Signature         string                         `json:"Signature"`
+	SigningCertURL    string                         `json:"SigningCertURL"`
+	UnsubscribeURL    string                         `json:"UnsubscribeURL"`
+	MessageAttributes map[string]SNSMessageAttribute `json:"MessageAttributes,omitempty"`
+	// signedTimestamp is Timestamp as SNS wrote and signed it
+	signedTimestamp string
 }
-type MessageHandler func(*SNSMessage) error
 
-func (mh MessageHandler) handle(message *SNSMessage) error { return mh(message) }
+// UnmarshalJSON keeps Timestamp as written too, for the signature.
+func (m *SNSMessage) UnmarshalJSON(data []byte) error {
+	type envelope SNSMessage
+	raw := struct {
+		*envelope
+		Timestamp string `json:"Timestamp"`
+	}{envelope: (*envelope)(m)}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	m.Timestamp, m.signedTimestamp = time.Time{}, raw.Timestamp
+	if raw.Timestamp != "" {
+		timestamp, err := time.Parse(time.RFC3339Nano, raw.Timestamp)
+		if err != nil {
+			return err
+		}
+		m.Timestamp = timestamp
+	}
+	return nil
+}
+
+// SNSMessageAttribute Type is String, String.Array, Number or Binary
+// (base64 encoded Value).
+type SNSMessageAttribute struct {
+	Type  string `json:"Type"`
+	Value string `json:"Value"`
+}
+
+const (
+	// maxBatchSize is the most entries SQS takes in one batch call.
+	maxBatchSize = 10
+	ackAttempts  = 3
+	// ackTimeout bounds deleting a receive, retries included, which runs
+	// on a context of its own so stopping doesn't redeliver what's handled.
+	ackTimeout = 10 * time.Second
+)
+
+// defaultVisibilityTimeout is what SQS gives a queue unless told otherwise.
+const defaultVisibilityTimeout = 30 * time.Second
 
 type consumer struct {
 	*sqs.SQS
@@ -28,8 +78,10 @@ type consumer struct {
 	url, name           string
 	waitTimeSeconds     int
 	maxNumberOfMessages int
+	options             ConsumerOptions
 	workers             map[int]*consumerWorker
 	stopped             []chan struct{}
+	logger              logrus.FieldLogger
 }
 
 func (c *consumer) consume(ctx aws.Context) ([]*sqs.Message, error) {
@@ -46,22 +98,109 @@ func (c *consumer) consume(ctx aws.Context) ([]*sqs.Message, error) {
 	}); err != nil {
 		return nil, err
 	} else {
-		if len(output.Messages) > 0 {
-			return output.Messages, nil
-		} else {
-			return nil, fmt.Errorf("empty q")
+		return output.Messages, nil
+	}
+}
+
+// ack deletes messages in batches of up to 10, entries failing on the
+// SQS side are retried a few times, what's left is reported back.
+func (c *consumer) ack(ctx aws.Context, messages ...*sqs.Message) error {
+	var failed []string
+	for start := 0; start < len(messages); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(messages) {
+			end = len(messages)
+		}
+		pending := make(map[string]*sqs.Message, end-start)
+		for i, message := range messages[start:end] {
+			pending[strconv.Itoa(i)] = message
 		}
+		for attempt := 1; len(pending) > 0; attempt++ {
+			entries := make([]*sqs.DeleteMessageBatchRequestEntry, 0, len(pending))
+			for id, message := range pending {
+				entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+					Id:            aws.String(id),
+					ReceiptHandle: message.ReceiptHandle,
+				})
+			}
+			output, err := c.DeleteMessageBatchWithContext(ctx, &sqs.DeleteMessageBatchInput{
+				QueueUrl: aws.String(c.url),
+				Entries:  entries,
+			})
+			retryable, reasons := make(map[string]*sqs.Message), make(map[string]string)
+			if err != nil {
+				for id, message := range pending {
+					retryable[id], reasons[id] = message, err.Error()
+				}
+			} else {
+				for _, f := range output.Failed {
+					id := aws.StringValue(f.Id)
+					if aws.BoolValue(f.SenderFault) {
+						failed = append(failed, fmt.Sprintf("%s(%s)",
+							aws.StringValue(pending[id].MessageId), aws.StringValue(f.Message)))
+					} else {
+						retryable[id], reasons[id] = pending[id], aws.StringValue(f.Message)
+					}
+				}
+			}
+			if len(retryable) > 0 && attempt >= ackAttempts {
+				for id, message := range retryable {
+					failed = append(failed, fmt.Sprintf("%s(%s)",
+						aws.StringValue(message.MessageId), reasons[id]))
+				}
+				break
+			}
+			pending = retryable
+			if len(pending) > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+				}
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("delete failed: %s", strings.Join(failed, ", "))
 	}
+	return nil
 }
-func (c *consumer) ack(ctx aws.Context, message *sqs.Message) error {
-	if _, err := c.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
-		QueueUrl:      aws.String(c.url),
-		ReceiptHandle: message.ReceiptHandle,
-	}); err != nil {
-		return err
-	} else {
-		return nil
+
+// deadLetter moves message to the dead letter queue, the caller deletes it
+// from this one once moved.
+func (c *consumer) deadLetter(ctx aws.Context, message *sqs.Message) error {
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(c.options.DeadLetterQueueURL),
+		MessageBody:       message.Body,
+		MessageAttributes: message.MessageAttributes,
+	}
+	if strings.HasSuffix(c.options.DeadLetterQueueURL, ".fifo") {
+		group := aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+		if group == "" {
+			group = c.name
+		}
+		input.MessageGroupId = aws.String(group)
+		input.MessageDeduplicationId = message.MessageId
 	}
+	_, err := c.SendMessageWithContext(ctx, input)
+	return err
+}
+
+func (c *consumer) changeVisibility(ctx aws.Context, message *sqs.Message, seconds int64) error {
+	_, err := c.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(c.url),
+		ReceiptHandle:     message.ReceiptHandle,
+		VisibilityTimeout: aws.Int64(seconds),
+	})
+	return err
+}
+
+func (c *consumer) Panics() uint64 {
+	var panics uint64
+	for _, w := range c.workers {
+		panics += atomic.LoadUint64(&w.panics)
+	}
+	return panics
 }
 
 func (c *consumer) Name() string { return "SQS:C" }
@@ -72,7 +211,21 @@ func (c *consumer) Stop() {
 	}
 }
 
+func (c *consumer) visibilityTimeout() time.Duration { return c.options.VisibilityTimeout }
+
 func (c *consumer) Run() {
+	if c.options.VisibilityTimeout == 0 {
+		c.options.VisibilityTimeout = defaultVisibilityTimeout
+		if output, err := c.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(c.url),
+			AttributeNames: []*string{aws.String(sqs.QueueAttributeNameVisibilityTimeout)},
+		}); err != nil {
+			c.logger.WithField("&", "Run@visibilityTimeout").Warn(err)
+		} else if seconds, err := strconv.Atoi(aws.StringValue(
+			output.Attributes[sqs.QueueAttributeNameVisibilityTimeout])); err == nil && seconds > 0 {
+			c.options.VisibilityTimeout = time.Duration(seconds) * time.Second
+		}
+	}
 	for _, v := range c.workers {
 		c.stopped = append(c.stopped, v.run(c))
 	}
@@ -80,29 +233,34 @@ func (c *consumer) Run() {
 
 func newConsumer(
 	parentCtx aws.Context,
-	region, url, name string,
+	client *sqs.SQS,
+	url, name string,
 	waitTimeSeconds, maxNumberOfMessages, count int,
-	handler MessageHandler,
+	options ConsumerOptions,
+	handler Handler,
 	logger logrus.FieldLogger,
 ) Consumer {
 	ctx, cancelFn := context.WithCancel(parentCtx)
+	options = options.withDefaults(waitTimeSeconds > 0)
+	if strings.HasSuffix(url, ".fifo") {
+		options.FIFO = true
+	}
 	c := &consumer{
-		SQS: sqs.New(session.Must(session.NewSession(&aws.Config{
-			Region:   aws.String(region),
-			LogLevel: aws.LogLevel(aws.LogOff),
-		}))),
+		SQS:                 client,
 		cancelFn:            cancelFn,
 		url:                 url,
 		name:                name,
 		waitTimeSeconds:     waitTimeSeconds,
 		maxNumberOfMessages: maxNumberOfMessages,
+		options:             options,
 		workers: func() map[int]*consumerWorker {
 			workers := make(map[int]*consumerWorker, count)
 			for id := 0; id < count; id++ {
-				workers[id] = newConsumerWorker(ctx, id, name, handler, logger)
+				workers[id] = newConsumerWorker(ctx, id, name, options, handler, logger)
 			}
 			return workers
 		}(),
+		logger: logger.WithField("#", fmt.Sprintf("SQS:C(%s)", name)),
 	}
 	cleaner.Register(c)
 	return c
@@ -3,50 +3,245 @@ package snsqs
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/s4mli/bolsa/mq"
 	"github.com/sirupsen/logrus"
 )
 
+var errNotNotification = errors.New("not an SNS notification")
+
+// maxVisibilityTimeout is the longest SQS accepts, 12 hours.
+const maxVisibilityTimeout = 12 * time.Hour
+
+func visibilitySeconds(delay time.Duration) int64 {
+	if delay > maxVisibilityTimeout {
+		delay = maxVisibilityTimeout
+	}
+	return int64(delay.Round(time.Second) / time.Second)
+}
+
 type consumerWorker struct {
 	ctx      aws.Context
 	cancelFn context.CancelFunc
 	id       int
-	handler  MessageHandler
+	options  ConsumerOptions
+	handler  Handler
+	panics   uint64
 	logger   logrus.FieldLogger
 }
 
+func (w *consumerWorker) pause(d time.Duration) {
+	select {
+	case <-w.ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// decode unwraps the SNS envelope according to the options, only what has
+// a Type and a TopicArn is taken as a notification, any other JSON being
+// undecodable too, and verifies its signature when asked to.
+func (w *consumerWorker) decode(sqsMsg *sqs.Message) (*Delivery, error) {
+	if w.options.Envelope == EnvelopeRaw {
+		return newDelivery(nil, sqsMsg), nil
+	}
+	var snsMsg SNSMessage
+	err := json.Unmarshal([]byte(aws.StringValue(sqsMsg.Body)), &snsMsg)
+	if err == nil && (snsMsg.Type == "" || snsMsg.TopicArn == "") {
+		err = errNotNotification
+	}
+	if err != nil {
+		if w.options.Envelope == EnvelopeAuto || w.options.Undecodable == UndecodableRaw {
+			return newDelivery(nil, sqsMsg), nil
+		}
+		return nil, err
+	}
+	if w.options.Verifier != nil {
+		if err := w.options.Verifier.Verify(w.ctx, &snsMsg); err != nil {
+			return nil, fmt.Errorf("unverified %s: %w", snsMsg.MessageId, err)
+		}
+	}
+	return newDelivery(&snsMsg, sqsMsg), nil
+}
+
+// heartbeat keeps sqsMsg invisible to others from receive until settled, by
+// extending it to the visibility timeout every half of it, until stopped.
+func (w *consumerWorker) heartbeat(c Consumer, sqsMsg *sqs.Message) (stop func()) {
+	timeout := c.visibilityTimeout()
+	if timeout <= 0 {
+		return func() {}
+	}
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-w.ctx.Done():
+				return
+			case <-ticker.C:
+				if err := c.changeVisibility(w.ctx, sqsMsg, visibilitySeconds(timeout)); err != nil {
+					w.logger.WithField("&", "run@heartbeat").Warn(err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// settle tells whether sqsMsg is to be deleted, which happens in batch
+// once the whole receive is handled. A plain error leaves the message to
+// its visibility timeout and the redrive policy of the queue, same as
+// rejecting it unless there is a dead letter queue to move it to. The
+// heartbeat keeps running only for what is to be deleted, it's stopped
+// before anything else, or an extension could undo a requeue or deferral.
+func (w *consumerWorker) settle(c Consumer, sqsMsg *sqs.Message, err error, stop func()) bool {
+	d := mq.DispositionOf(err, mq.Rejected)
+	if err != nil {
+		w.logger.WithField("&", "run@handle").Errorf("%s: %s", d.Action, err)
+	}
+	var explicit *mq.Disposition
+	switch d.Action {
+	case mq.Acked, mq.Dropped:
+		return true
+	case mq.Rejected:
+		if w.options.DeadLetterQueueURL != "" && errors.As(err, &explicit) {
+			if err := c.deadLetter(w.ctx, sqsMsg); err != nil {
+				w.logger.WithField("&", "run@deadLetter").Error(err)
+				stop()
+				return false
+			}
+			return true
+		}
+		stop()
+	case mq.Requeued, mq.Deferred:
+		stop()
+		if err := c.changeVisibility(w.ctx, sqsMsg, visibilitySeconds(d.Delay)); err != nil {
+			w.logger.WithField("&", "run@changeVisibility").Error(err)
+		}
+	default:
+		stop()
+	}
+	return false
+}
+
+// groups splits a receive into what runs in parallel, each message on its
+// own unless FIFO, when those of a MessageGroupId stay together in order.
+func (w *consumerWorker) groups(sqsMsgAll []*sqs.Message) [][]*sqs.Message {
+	var groups [][]*sqs.Message
+	index := make(map[string]int)
+	for _, sqsMsg := range sqsMsgAll {
+		id := aws.StringValue(sqsMsg.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+		if !w.options.FIFO || id == "" {
+			groups = append(groups, []*sqs.Message{sqsMsg})
+		} else if i, ok := index[id]; ok {
+			groups[i] = append(groups[i], sqsMsg)
+		} else {
+			index[id] = len(groups)
+			groups = append(groups, []*sqs.Message{sqsMsg})
+		}
+	}
+	return groups
+}
+
 func (w *consumerWorker) run(c Consumer) chan struct{} {
 	stopped := make(chan struct{})
 	handle := func(sqsMsgAll []*sqs.Message) {
-		var wg sync.WaitGroup
-		wg.Add(len(sqsMsgAll))
-		handleOne := func(sqsMsg *sqs.Message) {
-			defer wg.Done()
-			var snsMsg SNSMessage
-			if err := json.Unmarshal([]byte(*sqsMsg.Body), &snsMsg); err != nil {
+		var (
+			wg    sync.WaitGroup
+			mu    sync.Mutex
+			acks  []*sqs.Message
+			stops []func()
+		)
+		/*
+			messages waiting their turn in a group are kept invisible too
+		*/
+		heartbeats := make(map[*sqs.Message]func(), len(sqsMsgAll))
+		for _, sqsMsg := range sqsMsgAll {
+			heartbeats[sqsMsg] = w.heartbeat(c, sqsMsg)
+		}
+		handleOne := func(sqsMsg *sqs.Message) bool {
+			var err error
+			stop := heartbeats[sqsMsg]
+			if d, e := w.decode(sqsMsg); e != nil {
 				w.logger.WithFields(logrus.Fields{
-					"&": "run@Unmarshal",
-					"*": *sqsMsg.Body,
-				}).Error(err)
+					"&": "run@decode",
+					"*": aws.StringValue(sqsMsg.Body),
+				}).Error(e)
+				if w.options.Undecodable == UndecodableDrop {
+					err = mq.Drop(e)
+				} else {
+					err = mq.Reject(e)
+				}
 			} else {
-				if err := w.handler.handle(&snsMsg); err == nil {
-					if err := c.ack(w.ctx, sqsMsg); err != nil {
-						w.logger.WithField("&", "run@ack").Error(err)
-					}
+				err = mq.Invoke(&w.panics, w.logger.WithField("&", "run@handle"), func() error {
+					return w.handler.handle(w.ctx, d)
+				})
+			}
+			if w.settle(c, sqsMsg, err, stop) {
+				/*
+					keep it invisible until deleted along with the others
+				*/
+				mu.Lock()
+				acks, stops = append(acks, sqsMsg), append(stops, stop)
+				mu.Unlock()
+				return true
+			}
+			return false
+		}
+		// skip hands the rest of a group back to SQS right away, which
+		// redelivers it in order after the one that wasn't deleted.
+		skip := func(sqsMsgAll []*sqs.Message) {
+			for _, sqsMsg := range sqsMsgAll {
+				heartbeats[sqsMsg]()
+				if err := c.changeVisibility(w.ctx, sqsMsg, 0); err != nil {
+					w.logger.WithField("&", "run@skip").Error(err)
 				}
 			}
 		}
-		for _, sqsMsg := range sqsMsgAll {
-			go handleOne(sqsMsg)
+		for _, group := range w.groups(sqsMsgAll) {
+			wg.Add(1)
+			go func(group []*sqs.Message) {
+				defer wg.Done()
+				for i, sqsMsg := range group {
+					if !handleOne(sqsMsg) && i < len(group)-1 {
+						w.logger.WithField("&", "run@group").Warnf("%d left to keep %s in order",
+							len(group)-1-i, aws.StringValue(sqsMsg.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]))
+						skip(group[i+1:])
+						return
+					}
+				}
+			}(group)
 		}
 		wg.Wait()
+		if len(acks) > 0 {
+			/*
+				handled is handled, deleting them outlives the worker
+			*/
+			ctx, cancel := context.WithTimeout(context.Background(), ackTimeout)
+			if err := c.ack(ctx, acks...); err != nil {
+				w.logger.WithField("&", "run@ack").Error(err)
+			}
+			cancel()
+		}
+		for _, stop := range stops {
+			stop()
+		}
 	}
 
 	go func() {
+		failed, empty := 0, 0
 		for {
 			select {
 			case <-w.ctx.Done():
@@ -55,8 +250,18 @@ func (w *consumerWorker) run(c Consumer) chan struct{} {
 				return
 			default:
 				if messages, err := c.consume(w.ctx); err != nil {
-					w.logger.WithField("&", "run@consume").Error(err)
+					if w.ctx.Err() == nil {
+						failed, empty = failed+1, 0
+						w.logger.WithField("&", "run@consume").Errorf("%s, attempt %d", err, failed)
+						w.pause(backoff(w.options.ErrorBackoff, w.options.ErrorBackoffMax, failed))
+					}
+				} else if len(messages) == 0 {
+					failed, empty = 0, empty+1
+					if w.options.EmptyBackoff > 0 {
+						w.pause(backoff(w.options.EmptyBackoff, w.options.EmptyBackoffMax, empty))
+					}
 				} else {
+					failed, empty = 0, 0
 					handle(messages)
 				}
 			}
@@ -69,7 +274,8 @@ func newConsumerWorker(
 	parentContext aws.Context,
 	id int,
 	name string,
-	handler MessageHandler,
+	options ConsumerOptions,
+	handler Handler,
 	logger logrus.FieldLogger,
 ) *consumerWorker {
 	ctx, cancelFn := context.WithCancel(parentContext)
@@ -77,6 +283,7 @@ func newConsumerWorker(
 		ctx:      ctx,
 		cancelFn: cancelFn,
 		id:       id,
+		options:  options,
 		handler:  handler,
 		logger:   logger.WithField("#", fmt.Sprintf("SQS:C(%s,%d)", name, id)),
 	}
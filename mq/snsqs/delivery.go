@@ -0,0 +1,98 @@
+package snsqs
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/s4mli/bolsa/mq"
+)
+
+// Delivery is what a Handler gets, the SNS envelope along with the SQS
+// message it arrived in, deleting it is left to the worker. Body is the
+// payload, the SNS Message or the SQS body as is for raw deliveries, whose
+// SNSMessage only has Message and MessageId filled in. Attributes are the SQS system attributes, the
+// most useful of them parsed already, MessageAttributes the SQS ones which
+// an SNS envelope carries in SNSMessage unless delivered raw.
+type Delivery struct {
+	*SNSMessage
+	Raw                    bool
+	Body                   string
+	SQS                    *sqs.Message
+	ReceiveCount           int
+	SentTimestamp          time.Time
+	FirstReceiveTimestamp  time.Time
+	SenderId               string
+	MessageGroupId         string
+	MessageDeduplicationId string
+	SequenceNumber         string
+	Attributes             map[string]string
+	MessageAttributes      map[string]*sqs.MessageAttributeValue
+}
+
+func epochMillis(s string) time.Time {
+	if millis, err := strconv.ParseInt(s, 10, 64); err != nil {
+		return time.Time{}
+	} else {
+		return time.Unix(0, millis*int64(time.Millisecond))
+	}
+}
+
+func newDelivery(snsMsg *SNSMessage, sqsMsg *sqs.Message) *Delivery {
+	d := &Delivery{
+		SNSMessage:        snsMsg,
+		Raw:               snsMsg == nil,
+		Body:              aws.StringValue(sqsMsg.Body),
+		SQS:               sqsMsg,
+		Attributes:        aws.StringValueMap(sqsMsg.Attributes),
+		MessageAttributes: sqsMsg.MessageAttributes,
+	}
+	if snsMsg != nil {
+		d.Body = snsMsg.Message
+	} else {
+		d.SNSMessage = &SNSMessage{Message: d.Body, MessageId: aws.StringValue(sqsMsg.MessageId)}
+	}
+	d.ReceiveCount, _ = strconv.Atoi(d.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount])
+	d.SentTimestamp = epochMillis(d.Attributes[sqs.MessageSystemAttributeNameSentTimestamp])
+	d.FirstReceiveTimestamp = epochMillis(
+		d.Attributes[sqs.MessageSystemAttributeNameApproximateFirstReceiveTimestamp])
+	d.SenderId = d.Attributes[sqs.MessageSystemAttributeNameSenderId]
+	d.MessageGroupId = d.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]
+	d.MessageDeduplicationId = d.Attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId]
+	d.SequenceNumber = d.Attributes[sqs.MessageSystemAttributeNameSequenceNumber]
+	return d
+}
+
+// Handler is called for every message received, its context being
+// cancelled as the consumer stops, deletes of what was handled still go out.
+type Handler func(context.Context, *Delivery) error
+
+func (h Handler) handle(ctx context.Context, d *Delivery) error { return h(ctx, d) }
+
+// WithTimeout cancels the context of each call after timeout, worth keeping
+// below the visibility timeout when the heartbeat is off.
+func (h Handler) WithTimeout(timeout time.Duration) Handler {
+	return func(ctx context.Context, d *Delivery) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return h(ctx, d)
+	}
+}
+
+// OnPanic settles a message with action when h panics, instead of rejecting
+// it to DeadLetterQueueURL, or the redrive policy of the queue without one.
+func (h Handler) OnPanic(action mq.Action) Handler {
+	return func(ctx context.Context, d *Delivery) error {
+		return mq.Recovered(action, func() error { return h(ctx, d) })
+	}
+}
+
+type MessageHandler func(*SNSMessage) error
+
+// Handler adapts the plain signature, it never sees the context, raw
+// deliveries come as an envelope with only Message and MessageId.
+func (mh MessageHandler) Handler() Handler {
+	return func(_ context.Context, d *Delivery) error { return mh(d.SNSMessage) }
+}
@@ -1,7 +1,10 @@
 package snsqs
 
 import (
+	"time"
+
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/s4mli/bolsa/cleaner"
 	"github.com/sirupsen/logrus"
@@ -10,24 +13,35 @@ import (
 type Consumer interface {
 	cleaner.Cleanable
 	Run()
+	// Panics counts handler panics recovered by all workers.
+	Panics() uint64
 	consume(aws.Context) ([]*sqs.Message, error)
-	ack(aws.Context, *sqs.Message) error
+	ack(aws.Context, ...*sqs.Message) error
+	changeVisibility(aws.Context, *sqs.Message, int64) error
+	deadLetter(aws.Context, *sqs.Message) error
+	visibilityTimeout() time.Duration
 }
 
-type OnPublished func(message []byte, messageId string, failed error)
+// OnPublished gets message as it went out, defaults and SequenceNumber
+// filled in.
+type OnPublished func(message Message, messageId string, failed error)
 
 type Publisher interface {
 	cleaner.Cleanable
 	Run(OnPublished)
+	Publish([]byte)
+	PublishMessage(Message)
 	PublishJson(interface{}) error
-	publish(aws.Context, []byte) (string, error)
+	PublishJsonMessage(interface{}, Message) error
+	sender
 }
 
 /***********/
 /* Facade */
 /*********/
 type Broker struct {
-	region string
+	sqs *sqs.SQS
+	sns *sns.SNS
 }
 
 func (b *Broker) RunConsumer(
@@ -36,19 +50,37 @@ func (b *Broker) RunConsumer(
 	waitTimeSeconds int,
 	maxNumberOfMessages int,
 	workers int,
-	handler MessageHandler,
-	logger logrus.FieldLogger) {
-	newConsumer(ctx, b.region, url, name, waitTimeSeconds,
-		maxNumberOfMessages, workers, handler, logger).Run()
+	options ConsumerOptions,
+	handler Handler,
+	logger logrus.FieldLogger) Consumer {
+	c := newConsumer(ctx, b.sqs, url, name, waitTimeSeconds,
+		maxNumberOfMessages, workers, options, handler, logger)
+	c.Run()
+	return c
 }
 
 func (b *Broker) RunPublisher(
 	ctx aws.Context,
 	topicArn, topicName string,
 	workers int,
+	options PublisherOptions,
+	published OnPublished,
+	logger logrus.FieldLogger) Publisher {
+	p := newPublisher(ctx, b.sns, topicArn, topicName, workers, options, logger)
+	p.Run(published)
+	return p
+}
+
+// RunProducer sends to an SQS queue directly, with the same options and
+// callback as publishing to SNS.
+func (b *Broker) RunProducer(
+	ctx aws.Context,
+	queueUrl, queueName string,
+	workers int,
+	options PublisherOptions,
 	published OnPublished,
 	logger logrus.FieldLogger) Publisher {
-	p := newPublisher(ctx, b.region, topicArn, topicName, workers, logger)
+	p := newProducer(ctx, b.sqs, queueUrl, queueName, workers, options, logger)
 	p.Run(published)
 	return p
 }
@@ -57,17 +89,24 @@ func (b *Broker) RunPair(
 	ctx aws.Context,
 	topicArn, topicName string,
 	publisherWorkers int,
+	publisherOptions PublisherOptions,
 	published OnPublished,
 	queueUrl, queueName string,
 	queueWaitTimeSeconds, queueMaxNumberOfMessages int,
 	consumerWorkers int,
-	handler MessageHandler,
+	consumerOptions ConsumerOptions,
+	handler Handler,
 	logger logrus.FieldLogger) Publisher {
 	b.RunConsumer(ctx, queueUrl, queueName, queueWaitTimeSeconds,
-		queueMaxNumberOfMessages, consumerWorkers, handler, logger)
-	return b.RunPublisher(ctx, topicArn, topicName, publisherWorkers, published, logger)
+		queueMaxNumberOfMessages, consumerWorkers, consumerOptions, handler, logger)
+	return b.RunPublisher(ctx, topicArn, topicName, publisherWorkers, publisherOptions, published, logger)
 }
 
-func NewBroker(region string) *Broker {
-	return &Broker{region}
+// NewBroker builds one session shared by all its publishers and consumers.
+func NewBroker(options Options) *Broker {
+	sess := options.session()
+	return &Broker{
+		sqs: sqs.New(sess, options.endpoint(options.SQSEndpoint)),
+		sns: sns.New(sess, options.endpoint(options.SNSEndpoint)),
+	}
 }
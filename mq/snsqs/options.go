@@ -0,0 +1,178 @@
+package snsqs
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Options tells the Broker how to reach AWS or a local stand-in such as
+// ElasticMQ or LocalStack. Endpoint overrides both services, SQSEndpoint and
+// SNSEndpoint only one. A given Session is used as is, with only the
+// endpoint overrides applied on top, everything else is ignored then.
+type Options struct {
+	Region      string                   `yaml:"region"`
+	Endpoint    string                   `yaml:"endpoint"`
+	SQSEndpoint string                   `yaml:"sqsEndpoint"`
+	SNSEndpoint string                   `yaml:"snsEndpoint"`
+	Profile     string                   `yaml:"profile"`
+	RoleArn     string                   `yaml:"roleArn"`
+	MaxRetries  *int                     `yaml:"maxRetries"`
+	Credentials *credentials.Credentials `yaml:"-"`
+	HTTPClient  *http.Client             `yaml:"-"`
+	Session     *session.Session         `yaml:"-"`
+}
+
+func (o *Options) session() *session.Session {
+	if o.Session != nil {
+		return o.Session
+	}
+	config := aws.Config{
+		LogLevel:    aws.LogLevel(aws.LogOff),
+		Credentials: o.Credentials,
+		HTTPClient:  o.HTTPClient,
+		MaxRetries:  o.MaxRetries,
+	}
+	if o.Region != "" {
+		config.Region = aws.String(o.Region)
+	}
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		Config:            config,
+		Profile:           o.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+	if o.RoleArn != "" {
+		sess = sess.Copy(&aws.Config{Credentials: stscreds.NewCredentials(sess, o.RoleArn)})
+	}
+	return sess
+}
+
+func (o *Options) endpoint(service string) *aws.Config {
+	if service == "" {
+		service = o.Endpoint
+	}
+	if service == "" {
+		return &aws.Config{}
+	}
+	return &aws.Config{Endpoint: aws.String(service)}
+}
+
+const (
+	// EnvelopeSNS expects every body to be an SNS notification
+	EnvelopeSNS = "sns"
+	// EnvelopeRaw hands bodies over as they are, direct sends or SNS raw
+	// message delivery
+	EnvelopeRaw = "raw"
+	// EnvelopeAuto unwraps SNS notifications and hands anything else raw
+	EnvelopeAuto = "auto"
+)
+
+const (
+	// UndecodableReject leaves the message to the redrive policy
+	UndecodableReject = "reject"
+	// UndecodableDrop deletes the message
+	UndecodableDrop = "drop"
+	// UndecodableRaw hands the message over raw
+	UndecodableRaw = "raw"
+)
+
+// ConsumerOptions tunes how messages are received and kept while handled.
+// VisibilityTimeout is what in-flight messages get extended to, periodically
+// while their handler runs, 0 reads it from the queue, negative turns the
+// heartbeat off. Receiving pauses after empty receives and after errors,
+// doubling from the initial pause up to the max one, until a receive
+// brings messages again. Zero durations take the defaults, except that
+// long polling already waits on empty queues, EmptyBackoff stays off then.
+// Envelope defaults to EnvelopeSNS, where Undecodable (UndecodableReject by
+// default) tells what happens to bodies which aren't SNS notifications.
+// With a Verifier, or Verify for the default one, notifications whose
+// signature doesn't check out are treated the same, except that they are
+// never handed over raw. Auto detected raw bodies aren't verified.
+// FIFO, on by itself for queue urls ending in .fifo, handles the messages of
+// a MessageGroupId one after the other in receive order, groups in parallel,
+// handing the rest of a group straight back once one of them isn't deleted.
+// Without a DeadLetterQueueURL rejected messages take the redrive policy of
+// the queue, coming back until its maxReceiveCount, with one they are moved
+// there straight away, as a dead letter exchange does on rabbit. Plain
+// errors still come back, that being how SQS retries.
+type ConsumerOptions struct {
+	Envelope           string        `yaml:"envelope"`
+	Undecodable        string        `yaml:"undecodable"`
+	Verify             bool          `yaml:"verify"`
+	Verifier           *Verifier     `yaml:"-"`
+	FIFO               bool          `yaml:"fifo"`
+	DeadLetterQueueURL string        `yaml:"deadLetterQueueUrl"`
+	VisibilityTimeout  time.Duration `yaml:"visibilityTimeout"`
+	EmptyBackoff       time.Duration `yaml:"emptyBackoff"`
+	EmptyBackoffMax    time.Duration `yaml:"emptyBackoffMax"`
+	ErrorBackoff       time.Duration `yaml:"errorBackoff"`
+	ErrorBackoffMax    time.Duration `yaml:"errorBackoffMax"`
+}
+
+func (o ConsumerOptions) withDefaults(longPolling bool) ConsumerOptions {
+	if o.Envelope == "" {
+		o.Envelope = EnvelopeSNS
+	}
+	if o.Undecodable == "" {
+		o.Undecodable = UndecodableReject
+	}
+	if o.Verify && o.Verifier == nil {
+		o.Verifier = &Verifier{}
+	}
+	if o.EmptyBackoff == 0 && !longPolling {
+		o.EmptyBackoff = 200 * time.Millisecond
+	}
+	if o.EmptyBackoffMax < o.EmptyBackoff {
+		o.EmptyBackoffMax = atLeast(o.EmptyBackoff, 10*time.Second)
+	}
+	if o.ErrorBackoff <= 0 {
+		o.ErrorBackoff = time.Second
+	}
+	if o.ErrorBackoffMax < o.ErrorBackoff {
+		o.ErrorBackoffMax = atLeast(o.ErrorBackoff, time.Minute)
+	}
+	return o
+}
+
+// PublisherOptions turns batching on with Batch over 1, up to 10 messages
+// go out in one PublishBatch call as soon as that many are waiting, or
+// Linger (50ms by default) after the first of them, whichever comes first.
+type PublisherOptions struct {
+	Batch  int           `yaml:"batch"`
+	Linger time.Duration `yaml:"linger"`
+}
+
+func (o PublisherOptions) withDefaults() PublisherOptions {
+	if o.Batch > maxBatchSize {
+		o.Batch = maxBatchSize
+	}
+	if o.Linger <= 0 {
+		o.Linger = 50 * time.Millisecond
+	}
+	return o
+}
+
+func atLeast(d, min time.Duration) time.Duration {
+	if d < min {
+		return min
+	}
+	return d
+}
+
+// backoff is the pause after n (from 1) consecutive empty or failed
+// receives, jittered by up to a fifth so workers don't poll in lockstep.
+func backoff(initial, max time.Duration, n int) time.Duration {
+	delay := initial
+	for i := 1; i < n && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay)/5+1))
+}
@@ -0,0 +1,161 @@
+package snsqs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sirupsen/logrus"
+)
+
+// sender is what differs between publishing to SNS and sending to SQS.
+type sender interface {
+	publish(aws.Context, *Message) (string, error)
+	publishBatch(aws.Context, []*Message) ([]string, []error)
+}
+
+// outbox is what publisher and producer share, messages queued up for the
+// workers which hand them over to the sender, one by one or in batches.
+// FIFO destinations get one worker, or messages would go out in any order,
+// and defaults for their group and deduplication ids, group being the
+// destination name.
+type outbox struct {
+	cancelFn context.CancelFunc
+	fifo     bool
+	group    string
+	inputCh  chan content
+	workers  map[int]*publisherWorker
+	stopped  []chan struct{}
+}
+
+func (o *outbox) withDefaults(message *Message) {
+	if o.fifo {
+		message.fifoDefaults(o.group)
+	}
+}
+
+func (o *outbox) Stop() {
+	o.cancelFn()
+	for _, stopped := range o.stopped {
+		<-stopped
+	}
+}
+
+func (o *outbox) Publish(message []byte) {
+	o.PublishMessage(Message{Body: message})
+}
+
+func (o *outbox) PublishMessage(message Message) {
+	o.inputCh <- content{message: message}
+}
+
+func (o *outbox) PublishJson(message interface{}) error {
+	return o.PublishJsonMessage(message, Message{})
+}
+
+func (o *outbox) PublishJsonMessage(data interface{}, message Message) error {
+	if jsonMessage, err := json.Marshal(data); err != nil {
+		return err
+	} else {
+		message.Body = jsonMessage
+		o.PublishMessage(message)
+		return nil
+	}
+}
+
+func (o *outbox) run(s sender, published OnPublished) {
+	for _, v := range o.workers {
+		o.stopped = append(o.stopped, v.run(s, o.inputCh, published))
+	}
+}
+
+func newOutbox(
+	parentCtx aws.Context,
+	kind, name string,
+	count int,
+	fifo bool,
+	options PublisherOptions,
+	logger logrus.FieldLogger,
+) *outbox {
+	ctx, cancelFn := context.WithCancel(parentCtx)
+	options = options.withDefaults()
+	if fifo {
+		count = 1
+	}
+	return &outbox{
+		cancelFn: cancelFn,
+		fifo:     fifo,
+		group:    name,
+		inputCh:  make(chan content, count),
+		workers: func() map[int]*publisherWorker {
+			workers := make(map[int]*publisherWorker, count)
+			for id := 0; id < count; id++ {
+				workers[id] = newPublisherWorker(ctx, id, kind, name, options, logger)
+			}
+			return workers
+		}(),
+	}
+}
+
+// batchResult sorts out what a batch call did with each of messages, whose
+// entries are identified by their position.
+type batchResult struct {
+	messages []*Message
+	ids      []string
+	errs     []error
+}
+
+func newBatchResult(messages []*Message) *batchResult {
+	return &batchResult{
+		messages: messages,
+		ids:      make([]string, len(messages)),
+		errs:     make([]error, len(messages)),
+	}
+}
+
+func entryId(i int) *string { return aws.String(strconv.Itoa(i)) }
+
+func (r *batchResult) entry(id *string) (int, bool) {
+	i, err := strconv.Atoi(aws.StringValue(id))
+	return i, err == nil && i >= 0 && i < len(r.messages)
+}
+
+// pending tells whether message i still goes out, none failed upfront.
+func (r *batchResult) pending(i int) bool { return r.errs[i] == nil }
+
+func (r *batchResult) fail(i int, err error) { r.errs[i] = err }
+
+func (r *batchResult) failPending(err error) {
+	for i := range r.errs {
+		if r.pending(i) {
+			r.errs[i] = err
+		}
+	}
+}
+
+func (r *batchResult) succeeded(id, messageId, sequenceNumber *string) {
+	if i, ok := r.entry(id); ok {
+		r.ids[i] = aws.StringValue(messageId)
+		r.messages[i].SequenceNumber = aws.StringValue(sequenceNumber)
+	}
+}
+
+func (r *batchResult) failed(id, code, message *string) {
+	if i, ok := r.entry(id); ok {
+		r.errs[i] = fmt.Errorf("%s: %s", aws.StringValue(code), aws.StringValue(message))
+	}
+}
+
+// results are the message ids and errors by position, what the call left
+// out counts as failed.
+func (r *batchResult) results(call string) ([]string, []error) {
+	for i := range r.messages {
+		if r.ids[i] == "" && r.errs[i] == nil {
+			r.errs[i] = errors.New("missing from " + call + " result")
+		}
+	}
+	return r.ids, r.errs
+}
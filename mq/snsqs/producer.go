@@ -0,0 +1,172 @@
+package snsqs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/s4mli/bolsa/cleaner"
+	"github.com/sirupsen/logrus"
+)
+
+// maxDelay is the longest SQS delays a message, 15 minutes.
+const maxDelay = 15 * time.Minute
+
+var errFIFODelay = errors.New("FIFO queues take no per message delay")
+
+func delaySeconds(delay time.Duration) *int64 {
+	if delay <= 0 {
+		return nil
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return aws.Int64(int64(delay.Round(time.Second) / time.Second))
+}
+
+// sqsDataType tells whether SQS takes an attribute of dataType, String,
+// Number or Binary with an optional custom label, but not String.Array,
+// which only SNS has.
+func sqsDataType(dataType string) bool {
+	if dataType == "String.Array" {
+		return false
+	}
+	base := strings.SplitN(dataType, ".", 2)[0]
+	return base == "String" || base == "Number" || base == "Binary"
+}
+
+// toSQS carries attributes over, check has turned away what SQS doesn't take.
+func toSQS(attributes map[string]*sns.MessageAttributeValue) map[string]*sqs.MessageAttributeValue {
+	if len(attributes) == 0 {
+		return nil
+	}
+	values := make(map[string]*sqs.MessageAttributeValue, len(attributes))
+	for k, v := range attributes {
+		if v != nil {
+			values[k] = &sqs.MessageAttributeValue{
+				DataType:    v.DataType,
+				StringValue: v.StringValue,
+				BinaryValue: v.BinaryValue,
+			}
+		}
+	}
+	return values
+}
+
+// producer is a Publisher sending to an SQS queue directly.
+type producer struct {
+	*outbox
+	client   *sqs.SQS
+	queueUrl string
+}
+
+// check refuses what the queue would, a delay on a FIFO queue or an
+// attribute type SQS doesn't know, failing the message alone.
+func (p *producer) check(message *Message) error {
+	if p.fifo && message.Delay != 0 {
+		return errFIFODelay
+	}
+	for name, v := range message.Attributes {
+		if v == nil {
+			return fmt.Errorf("attribute %q: no value", name)
+		}
+		if dataType := aws.StringValue(v.DataType); !sqsDataType(dataType) {
+			return fmt.Errorf("attribute %q: SQS takes no %q type", name, dataType)
+		}
+	}
+	return nil
+}
+
+func (p *producer) publish(ctx aws.Context, message *Message) (string, error) {
+	if err := p.check(message); err != nil {
+		return "", err
+	}
+	p.withDefaults(message)
+	input := &sqs.SendMessageInput{
+		MessageBody:       aws.String(string(message.Body)),
+		MessageAttributes: toSQS(message.Attributes),
+		DelaySeconds:      delaySeconds(message.Delay),
+		QueueUrl:          aws.String(p.queueUrl),
+	}
+	if message.MessageGroupId != "" {
+		input.MessageGroupId = aws.String(message.MessageGroupId)
+	}
+	if message.MessageDeduplicationId != "" {
+		input.MessageDeduplicationId = aws.String(message.MessageDeduplicationId)
+	}
+	if output, err := p.client.SendMessageWithContext(ctx, input); err != nil {
+		return "", err
+	} else {
+		message.SequenceNumber = aws.StringValue(output.SequenceNumber)
+		return aws.StringValue(output.MessageId), nil
+	}
+}
+
+// publishBatch sends up to maxBatchSize messages in one call, telling
+// apart what failed by their position in messages.
+func (p *producer) publishBatch(ctx aws.Context, messages []*Message) ([]string, []error) {
+	result := newBatchResult(messages)
+	entries := make([]*sqs.SendMessageBatchRequestEntry, 0, len(messages))
+	for i, message := range messages {
+		if err := p.check(message); err != nil {
+			result.fail(i, err)
+			continue
+		}
+		p.withDefaults(message)
+		entry := &sqs.SendMessageBatchRequestEntry{
+			Id:                entryId(i),
+			MessageBody:       aws.String(string(message.Body)),
+			MessageAttributes: toSQS(message.Attributes),
+			DelaySeconds:      delaySeconds(message.Delay),
+		}
+		if message.MessageGroupId != "" {
+			entry.MessageGroupId = aws.String(message.MessageGroupId)
+		}
+		if message.MessageDeduplicationId != "" {
+			entry.MessageDeduplicationId = aws.String(message.MessageDeduplicationId)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return result.results("SendMessageBatch")
+	}
+	if output, err := p.client.SendMessageBatchWithContext(ctx, &sqs.SendMessageBatchInput{
+		Entries:  entries,
+		QueueUrl: aws.String(p.queueUrl),
+	}); err != nil {
+		result.failPending(err)
+	} else {
+		for _, s := range output.Successful {
+			result.succeeded(s.Id, s.MessageId, s.SequenceNumber)
+		}
+		for _, f := range output.Failed {
+			result.failed(f.Id, f.Code, f.Message)
+		}
+	}
+	return result.results("SendMessageBatch")
+}
+
+func (p *producer) Name() string              { return "SQS:P" }
+func (p *producer) Run(published OnPublished) { p.run(p, published) }
+
+func newProducer(
+	ctx aws.Context,
+	client *sqs.SQS,
+	queueUrl, queueName string,
+	count int,
+	options PublisherOptions,
+	logger logrus.FieldLogger,
+) Publisher {
+	p := &producer{
+		outbox: newOutbox(ctx, "SQS:P", queueName, count,
+			strings.HasSuffix(queueUrl, ".fifo"), options, logger),
+		client:   client,
+		queueUrl: queueUrl,
+	}
+	cleaner.Register(p)
+	return p
+}
@@ -0,0 +1,66 @@
+package snsqs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+func attribute(dataType string) *sns.MessageAttributeValue {
+	return &sns.MessageAttributeValue{DataType: aws.String(dataType), StringValue: aws.String("1")}
+}
+
+func TestProducerCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		fifo    bool
+		message Message
+		valid   bool
+	}{
+		{name: "plain", message: Message{Body: []byte("hi")}, valid: true},
+		{name: "delay", message: Message{Delay: time.Second}, valid: true},
+		{name: "fifo delay", fifo: true, message: Message{Delay: time.Second}},
+		{name: "sqs types", valid: true, message: Message{Attributes: map[string]*sns.MessageAttributeValue{
+			"s": attribute("String"), "n": attribute("Number"), "b": attribute("Binary"),
+			"custom": attribute("Number.int"),
+		}}},
+		{name: "string array", message: Message{Attributes: map[string]*sns.MessageAttributeValue{
+			"s": attribute("String"), "a": attribute("String.Array"),
+		}}},
+		{name: "unknown type", message: Message{Attributes: map[string]*sns.MessageAttributeValue{
+			"x": attribute("Date"),
+		}}},
+		{name: "no type", message: Message{Attributes: map[string]*sns.MessageAttributeValue{
+			"x": {StringValue: aws.String("1")},
+		}}},
+		{name: "nil", message: Message{Attributes: map[string]*sns.MessageAttributeValue{"x": nil}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &producer{outbox: &outbox{fifo: test.fifo}}
+			if err := p.check(&test.message); test.valid != (err == nil) {
+				t.Fatalf("expected valid %v, got %v", test.valid, err)
+			}
+		})
+	}
+}
+
+func TestProducerBatchFailsUnsupportedAlone(t *testing.T) {
+	p := &producer{outbox: &outbox{}}
+	messages := []*Message{
+		{Attributes: map[string]*sns.MessageAttributeValue{"a": attribute("String.Array")}},
+		{Attributes: map[string]*sns.MessageAttributeValue{"x": attribute("Date")}},
+	}
+	/*
+		nothing goes out, the client is never called
+	*/
+	ids, errs := p.publishBatch(aws.BackgroundContext(), messages)
+	for i := range messages {
+		if ids[i] != "" || errs[i] == nil || errors.Is(errs[i], errFIFODelay) {
+			t.Fatalf("%d: expected an attribute error, got %q %v", i, ids[i], errs[i])
+		}
+	}
+}
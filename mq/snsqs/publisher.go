@@ -1,89 +1,148 @@
 package snsqs
 
 import (
-	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/s4mli/bolsa/cleaner"
 	"github.com/sirupsen/logrus"
 )
 
+// Message is what gets published, Body along with what SNS takes besides,
+// Attributes being what subscription filter policies match on. FIFO topics
+// and queues need a MessageGroupId and, unless content based deduplication
+// is on, a MessageDeduplicationId, which default to the topic or queue name
+// and the SHA256 of Body. SequenceNumber is what they give FIFO messages.
+// Subject is for SNS only, Delay, up to 15 minutes and not for FIFO queues,
+// for SQS only.
+type Message struct {
+	Body                   []byte
+	Subject                string
+	Attributes             map[string]*sns.MessageAttributeValue
+	MessageGroupId         string
+	MessageDeduplicationId string
+	Delay                  time.Duration
+	SequenceNumber         string
+}
+
+func (m *Message) fifoDefaults(group string) {
+	if m.MessageGroupId == "" {
+		m.MessageGroupId = group
+	}
+	if m.MessageDeduplicationId == "" {
+		m.MessageDeduplicationId = fmt.Sprintf("%x", sha256.Sum256(m.Body))
+	}
+}
+
+// StringAttributes are attributes of the String data type.
+func StringAttributes(attributes map[string]string) map[string]*sns.MessageAttributeValue {
+	if len(attributes) == 0 {
+		return nil
+	}
+	values := make(map[string]*sns.MessageAttributeValue, len(attributes))
+	for k, v := range attributes {
+		values[k] = &sns.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(v),
+		}
+	}
+	return values
+}
+
 type content struct {
-	message   []byte
+	message   Message
 	messageId string
 	failed    error
 }
 
 type publisher struct {
-	*sns.SNS
-	cancelFn  context.CancelFunc
-	topicArn  string
-	topicName string
-	inputCh   chan content
-	workers   map[int]*publisherWorker
-	stopped   []chan struct{}
+	*outbox
+	client   *sns.SNS
+	topicArn string
 }
 
-func (p *publisher) publish(ctx aws.Context, message []byte) (string, error) {
-	if output, err := p.PublishWithContext(ctx, &sns.PublishInput{
-		Message:  aws.String(string(message)),
-		TopicArn: aws.String(p.topicArn),
-	}); err != nil {
+func (p *publisher) publish(ctx aws.Context, message *Message) (string, error) {
+	p.withDefaults(message)
+	input := &sns.PublishInput{
+		Message:           aws.String(string(message.Body)),
+		MessageAttributes: message.Attributes,
+		TopicArn:          aws.String(p.topicArn),
+	}
+	if message.Subject != "" {
+		input.Subject = aws.String(message.Subject)
+	}
+	if message.MessageGroupId != "" {
+		input.MessageGroupId = aws.String(message.MessageGroupId)
+	}
+	if message.MessageDeduplicationId != "" {
+		input.MessageDeduplicationId = aws.String(message.MessageDeduplicationId)
+	}
+	if output, err := p.client.PublishWithContext(ctx, input); err != nil {
 		return "", err
 	} else {
-		return *output.MessageId, nil
+		message.SequenceNumber = aws.StringValue(output.SequenceNumber)
+		return aws.StringValue(output.MessageId), nil
 	}
 }
 
-func (p *publisher) Name() string { return "SNS:P" }
-func (p *publisher) Stop() {
-	p.cancelFn()
-	for _, stopped := range p.stopped {
-		<-stopped
+// publishBatch publishes up to maxBatchSize messages in one call, telling
+// apart what failed by their position in messages.
+func (p *publisher) publishBatch(ctx aws.Context, messages []*Message) ([]string, []error) {
+	result := newBatchResult(messages)
+	entries := make([]*sns.PublishBatchRequestEntry, len(messages))
+	for i, message := range messages {
+		p.withDefaults(message)
+		entries[i] = &sns.PublishBatchRequestEntry{
+			Id:                entryId(i),
+			Message:           aws.String(string(message.Body)),
+			MessageAttributes: message.Attributes,
+		}
+		if message.Subject != "" {
+			entries[i].Subject = aws.String(message.Subject)
+		}
+		if message.MessageGroupId != "" {
+			entries[i].MessageGroupId = aws.String(message.MessageGroupId)
+		}
+		if message.MessageDeduplicationId != "" {
+			entries[i].MessageDeduplicationId = aws.String(message.MessageDeduplicationId)
+		}
 	}
-}
-
-func (p *publisher) PublishJson(message interface{}) error {
-	if jsonMessage, err := json.Marshal(message); err != nil {
-		return err
+	if output, err := p.client.PublishBatchWithContext(ctx, &sns.PublishBatchInput{
+		PublishBatchRequestEntries: entries,
+		TopicArn:                   aws.String(p.topicArn),
+	}); err != nil {
+		result.failPending(err)
 	} else {
-		p.inputCh <- content{message: jsonMessage}
-		return nil
+		for _, s := range output.Successful {
+			result.succeeded(s.Id, s.MessageId, s.SequenceNumber)
+		}
+		for _, f := range output.Failed {
+			result.failed(f.Id, f.Code, f.Message)
+		}
 	}
+	return result.results("PublishBatch")
 }
 
-func (p *publisher) Run(published OnPublished) {
-	for _, v := range p.workers {
-		p.stopped = append(p.stopped, v.run(p, p.inputCh, published))
-	}
-}
+func (p *publisher) Name() string              { return "SNS:P" }
+func (p *publisher) Run(published OnPublished) { p.run(p, published) }
 
 func newPublisher(
-	parentCtx aws.Context,
-	region, topicArn, topicName string,
+	ctx aws.Context,
+	client *sns.SNS,
+	topicArn, topicName string,
 	count int,
+	options PublisherOptions,
 	logger logrus.FieldLogger,
 ) Publisher {
-	ctx, cancelFn := context.WithCancel(parentCtx)
 	p := &publisher{
-		SNS: sns.New(session.Must(session.NewSession(&aws.Config{
-			Region:   aws.String(region),
-			LogLevel: aws.LogLevel(aws.LogOff),
-		}))),
-		cancelFn:  cancelFn,
-		topicArn:  topicArn,
-		topicName: topicName,
-		inputCh:   make(chan content, count),
-		workers: func() map[int]*publisherWorker {
-			workers := make(map[int]*publisherWorker, count)
-			for id := 0; id < count; id++ {
-				workers[id] = newPublisherWorker(ctx, id, topicName, logger)
-			}
-			return workers
-		}(),
+		outbox: newOutbox(ctx, "SNS:P", topicName, count,
+			strings.HasSuffix(topicArn, ".fifo"), options, logger),
+		client:   client,
+		topicArn: topicArn,
 	}
 	cleaner.Register(p)
 	return p
@@ -10,15 +10,115 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// maxBatchBytes is the most SNS takes in one PublishBatch call, all
+// messages together, attributes included.
+const maxBatchBytes = 256 * 1024
+
+// flushTimeout bounds the last flush, once the worker context is gone.
+const flushTimeout = 5 * time.Second
+
+// size is what m counts towards maxBatchBytes.
+func (m *Message) size() int {
+	size := len(m.Body)
+	for name, v := range m.Attributes {
+		size += len(name)
+		if v != nil {
+			size += len(aws.StringValue(v.DataType)) + len(aws.StringValue(v.StringValue)) + len(v.BinaryValue)
+		}
+	}
+	return size
+}
+
 type publisherWorker struct {
 	ctx      aws.Context
 	cancelFn context.CancelFunc
 	id       int
+	options  PublisherOptions
 	logger   logrus.FieldLogger
 }
 
-func (w *publisherWorker) run(p Publisher, inputCh chan content, onPublished OnPublished) chan struct{} {
+func (w *publisherWorker) report(d content, onPublished OnPublished) {
+	bodyInLog := strings.Replace(string(d.message.Body), "\"", "", -1)
+	if d.failed != nil {
+		w.logger.WithFields(logrus.Fields{
+			"&": "run@publish",
+			"*": bodyInLog,
+		}).Error(d.failed)
+	} else {
+		w.logger.WithFields(logrus.Fields{
+			"&": "run@publish",
+			"*": bodyInLog,
+		}).Info(d.messageId)
+	}
+	if onPublished != nil {
+		onPublished(d.message, d.messageId, d.failed)
+	}
+}
+
+// flush publishes batch in one call and reports each of its messages on
+// its own, in the order they came.
+func (w *publisherWorker) flush(ctx aws.Context, s sender, batch []content, onPublished OnPublished) {
+	if len(batch) == 0 {
+		return
+	}
+	messages := make([]*Message, len(batch))
+	for i := range batch {
+		messages[i] = &batch[i].message
+	}
+	ids, errs := s.publishBatch(ctx, messages)
+	for i, d := range batch {
+		d.messageId, d.failed = ids[i], errs[i]
+		w.report(d, onPublished)
+	}
+}
+
+// runBatch coalesces what comes in into batches, flushed when full, when
+// the next message wouldn't fit anymore, or once they lingered long enough.
+func (w *publisherWorker) runBatch(s sender, inputCh <-chan content, onPublished OnPublished, stopped chan struct{}) {
+	var (
+		batch  []content
+		size   int
+		linger <-chan time.Time
+	)
+	flush := func(ctx aws.Context) {
+		w.flush(ctx, s, batch, onPublished)
+		batch, size, linger = nil, 0, nil
+	}
+	for {
+		select {
+		case <-w.ctx.Done():
+			/*
+				what lingers still goes out, on a context of its own
+			*/
+			ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+			flush(ctx)
+			cancel()
+			w.logger.WithField("&", "run").Warn("!")
+			stopped <- struct{}{}
+			return
+		case d := <-inputCh:
+			if len(batch) > 0 && size+d.message.size() > maxBatchBytes {
+				flush(w.ctx)
+			}
+			if len(batch) == 0 {
+				linger = time.After(w.options.Linger)
+			}
+			batch, size = append(batch, d), size+d.message.size()
+			if len(batch) >= w.options.Batch {
+				flush(w.ctx)
+			}
+		case <-linger:
+			flush(w.ctx)
+		}
+	}
+}
+
+func (w *publisherWorker) run(s sender, inputCh chan content, onPublished OnPublished) chan struct{} {
 	stopped := make(chan struct{})
+	if w.options.Batch > 1 {
+		go w.runBatch(s, inputCh, onPublished, stopped)
+		return stopped
+	}
 	go func(inputCh <-chan content) {
 		for {
 			select {
@@ -27,22 +127,8 @@ func (w *publisherWorker) run(p Publisher, inputCh chan content, onPublished OnP
 				stopped <- struct{}{}
 				return
 			case d := <-inputCh:
-				bodyInLog := strings.Replace(string(d.message), "\"", "", -1)
-				d.messageId, d.failed = p.publish(w.ctx, d.message)
-				if d.failed != nil {
-					w.logger.WithFields(logrus.Fields{
-						"&": "run@publish",
-						"*": bodyInLog,
-					}).Error(d.failed)
-				} else {
-					w.logger.WithFields(logrus.Fields{
-						"&": "run@publish",
-						"*": bodyInLog,
-					}).Info(d.messageId)
-				}
-				if onPublished != nil {
-					onPublished(d.message, d.messageId, d.failed)
-				}
+				d.messageId, d.failed = s.publish(w.ctx, &d.message)
+				w.report(d, onPublished)
 			default:
 				time.Sleep(50 * time.Millisecond)
 			}
@@ -54,7 +140,8 @@ func (w *publisherWorker) run(p Publisher, inputCh chan content, onPublished OnP
 func newPublisherWorker(
 	parentContext aws.Context,
 	id int,
-	name string,
+	kind, name string,
+	options PublisherOptions,
 	logger logrus.FieldLogger,
 ) *publisherWorker {
 	ctx, cancelFn := context.WithCancel(parentContext)
@@ -62,6 +149,7 @@ func newPublisherWorker(
 		ctx:      ctx,
 		cancelFn: cancelFn,
 		id:       id,
-		logger:   logger.WithField("@", fmt.Sprintf("SNS:P(%s,%d)", name, id)),
+		options:  options,
+		logger:   logger.WithField("@", fmt.Sprintf("%s(%s,%d)", kind, name, id)),
 	}
 }
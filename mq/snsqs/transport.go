@@ -0,0 +1,129 @@
+package snsqs
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/s4mli/bolsa/mq"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	mq.Register("snsqs", func() mq.Transport { return &Transport{} })
+}
+
+// Transport runs SNS/SQS behind the mq interfaces, a destination is a topic
+// arn, or a queue url to send to directly, and a source a queue url.
+type Transport struct {
+	Options             `yaml:",inline"`
+	Workers             int              `yaml:"workers"`
+	WaitTimeSeconds     int              `yaml:"waitTimeSeconds"`
+	MaxNumberOfMessages int              `yaml:"maxNumberOfMessages"`
+	Consumer            ConsumerOptions  `yaml:"consumer"`
+	Publisher           PublisherOptions `yaml:"publisher"`
+	once                sync.Once
+	broker              *Broker
+}
+
+func (t *Transport) Broker() *Broker {
+	t.once.Do(func() { t.broker = NewBroker(t.Options) })
+	return t.broker
+}
+
+func (t *Transport) workers() int {
+	if t.Workers > 0 {
+		return t.Workers
+	}
+	return 1
+}
+
+func (t *Transport) RunPublisher(
+	ctx context.Context,
+	destination string,
+	published mq.OnPublished,
+	logger logrus.FieldLogger,
+) mq.Publisher {
+	var onPublished OnPublished
+	if published != nil {
+		onPublished = func(message Message, messageId string, failed error) {
+			published(&mq.Message{
+				Id:         messageId,
+				Topic:      destination,
+				Attributes: fromAttributes(message.Attributes),
+				Body:       message.Body,
+			}, failed)
+		}
+	}
+	if !strings.HasPrefix(destination, "arn:") {
+		return &transportPublisher{t.Broker().RunProducer(ctx, destination,
+			path.Base(destination), t.workers(), t.Publisher, onPublished, logger)}
+	}
+	return &transportPublisher{t.Broker().RunPublisher(ctx, destination, destination,
+		t.workers(), t.Publisher, onPublished, logger)}
+}
+
+func (t *Transport) RunConsumer(
+	ctx context.Context,
+	source string,
+	handler mq.Handler,
+	logger logrus.FieldLogger,
+) mq.Consumer {
+	maxNumberOfMessages := t.MaxNumberOfMessages
+	if maxNumberOfMessages <= 0 {
+		maxNumberOfMessages = 10
+	}
+	return t.Broker().RunConsumer(ctx, source, source, t.WaitTimeSeconds,
+		maxNumberOfMessages, t.workers(), t.Consumer, func(ctx context.Context, d *Delivery) error {
+			return handler(ctx, d.MQ())
+		}, logger)
+}
+
+type transportPublisher struct{ publisher Publisher }
+
+func (p *transportPublisher) Publish(m *mq.Message) error {
+	p.publisher.PublishMessage(Message{Body: m.Body, Attributes: StringAttributes(m.Attributes)})
+	return nil
+}
+
+func fromAttributes(values map[string]*sns.MessageAttributeValue) map[string]string {
+	attributes := make(map[string]string, len(values))
+	for k, v := range values {
+		if v != nil && v.StringValue != nil {
+			attributes[k] = aws.StringValue(v.StringValue)
+		}
+	}
+	return attributes
+}
+
+func (p *transportPublisher) PublishJson(_ string, v interface{}) error {
+	return p.publisher.PublishJson(v)
+}
+
+// MQ is the transport neutral view of d.
+func (d *Delivery) MQ() *mq.Message {
+	attributes := make(map[string]string, len(d.MessageAttributes))
+	for k, v := range d.MessageAttributes {
+		if v != nil && v.StringValue != nil {
+			attributes[k] = aws.StringValue(v.StringValue)
+		}
+	}
+	m := &mq.Message{
+		Id:           aws.StringValue(d.SQS.MessageId),
+		Attributes:   attributes,
+		Body:         []byte(d.Body),
+		Redelivered:  d.ReceiveCount > 1,
+		ReceiveCount: d.ReceiveCount,
+		Timestamp:    d.SentTimestamp,
+	}
+	if !d.Raw {
+		m.Id, m.Topic, m.Timestamp = d.MessageId, d.TopicArn, d.SNSMessage.Timestamp
+		for k, v := range d.SNSMessage.MessageAttributes {
+			attributes[k] = v.Value
+		}
+	}
+	return m
+}
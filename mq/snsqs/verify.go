@@ -0,0 +1,253 @@
+package snsqs
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snsTimestamp is how SNS writes Timestamp, signed as written, which is
+// what canonical goes by for messages built rather than decoded.
+const snsTimestamp = "2006-01-02T15:04:05.000Z"
+
+var (
+	errUnsigned         = errors.New("unsigned notification")
+	errBadSignature     = errors.New("signature mismatch")
+	defaultSigningHosts = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+)
+
+// CertificateFetcher gets the certificates SigningCertURL points to, the
+// signing one first, then whatever intermediates come along with it.
+type CertificateFetcher interface {
+	Fetch(ctx context.Context, certURL string) ([]*x509.Certificate, error)
+}
+
+type CertificateFetcherFunc func(ctx context.Context, certURL string) ([]*x509.Certificate, error)
+
+func (f CertificateFetcherFunc) Fetch(ctx context.Context, certURL string) ([]*x509.Certificate, error) {
+	return f(ctx, certURL)
+}
+
+// HTTPCertificateFetcher downloads PEM certificates, every block of the
+// file, with a client timing out after 10 seconds unless given one.
+type HTTPCertificateFetcher struct {
+	Client *http.Client
+}
+
+func (f *HTTPCertificateFetcher) Fetch(ctx context.Context, certURL string) ([]*x509.Certificate, error) {
+	client := f.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, certURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", certURL, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	return parseCertificates(certURL, data)
+}
+
+func parseCertificates(certURL string, data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, fmt.Errorf("fetching %s: %w", certURL, err)
+		} else {
+			certs = append(certs, cert)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("fetching %s: no PEM certificate", certURL)
+	}
+	return certs, nil
+}
+
+type certificateCache struct {
+	fetcher CertificateFetcher
+	mu      sync.Mutex
+	certs   map[string][]*x509.Certificate
+}
+
+// CachedCertificates fetches each certificate once, until it expires, SNS
+// signs with very few of them.
+func CachedCertificates(fetcher CertificateFetcher) CertificateFetcher {
+	return &certificateCache{fetcher: fetcher, certs: make(map[string][]*x509.Certificate)}
+}
+
+func (c *certificateCache) Fetch(ctx context.Context, certURL string) ([]*x509.Certificate, error) {
+	c.mu.Lock()
+	certs, ok := c.certs[certURL]
+	c.mu.Unlock()
+	if ok && time.Now().Before(certs[0].NotAfter) {
+		return certs, nil
+	}
+	certs, err := c.fetcher.Fetch(ctx, certURL)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("fetching %s: no certificate", certURL)
+	}
+	c.mu.Lock()
+	c.certs[certURL] = certs
+	c.mu.Unlock()
+	return certs, nil
+}
+
+// Verifier checks that notifications were signed by SNS, SignatureVersion 1
+// (SHA1) or 2 (SHA256), with a certificate from an allowed https host. The
+// zero value fetches certificates over https into a cache and trusts them
+// by their host alone, sns.<region>.amazonaws.com, https having vouched for
+// it already, the way the AWS validators do. With Roots the certificate has
+// to chain up to them too, through the intermediates fetched along with it,
+// which is how tests or offline setups plug in a local CA, along with their
+// own Fetcher and Hosts.
+type Verifier struct {
+	Fetcher CertificateFetcher
+	Roots   *x509.CertPool
+	Hosts   *regexp.Regexp
+	once    sync.Once
+}
+
+func (v *Verifier) init() {
+	v.once.Do(func() {
+		if v.Fetcher == nil {
+			v.Fetcher = CachedCertificates(&HTTPCertificateFetcher{})
+		}
+		if v.Hosts == nil {
+			v.Hosts = defaultSigningHosts
+		}
+	})
+}
+
+// canonical is the string SNS signs for a notification, its fields in
+// alphabetical order, Subject only when there is one, Timestamp as received.
+func canonical(m *SNSMessage) string {
+	var b strings.Builder
+	field := func(name, value string) {
+		b.WriteString(name)
+		b.WriteByte('\n')
+		b.WriteString(value)
+		b.WriteByte('\n')
+	}
+	field("Message", m.Message)
+	field("MessageId", m.MessageId)
+	if m.Subject != "" {
+		field("Subject", m.Subject)
+	}
+	if m.signedTimestamp != "" {
+		field("Timestamp", m.signedTimestamp)
+	} else {
+		field("Timestamp", m.Timestamp.UTC().Format(snsTimestamp))
+	}
+	field("TopicArn", m.TopicArn)
+	field("Type", m.Type)
+	return b.String()
+}
+
+func (v *Verifier) certificate(ctx context.Context, m *SNSMessage) (*x509.Certificate, error) {
+	u, err := url.Parse(m.SigningCertURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || !v.Hosts.MatchString(u.Hostname()) {
+		return nil, fmt.Errorf("untrusted SigningCertURL %q", m.SigningCertURL)
+	}
+	certs, err := v.Fetcher.Fetch(ctx, m.SigningCertURL)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate at %s", m.SigningCertURL)
+	}
+	cert, now := certs[0], time.Now()
+	if v.Roots == nil {
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return nil, fmt.Errorf("certificate at %s expired or not yet valid", m.SigningCertURL)
+		}
+		return cert, nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         v.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Verify tells why m can't be trusted, nil when it can.
+func (v *Verifier) Verify(ctx context.Context, m *SNSMessage) error {
+	v.init()
+	if m.Type != "Notification" {
+		return fmt.Errorf("can't verify %q messages", m.Type)
+	}
+	if m.Signature == "" || m.SigningCertURL == "" {
+		return errUnsigned
+	}
+	var (
+		hash   crypto.Hash
+		digest []byte
+		signed = []byte(canonical(m))
+	)
+	switch m.SignatureVersion {
+	case "1":
+		sum := sha1.Sum(signed)
+		hash, digest = crypto.SHA1, sum[:]
+	case "2":
+		sum := sha256.Sum256(signed)
+		hash, digest = crypto.SHA256, sum[:]
+	default:
+		return fmt.Errorf("unknown SignatureVersion %q", m.SignatureVersion)
+	}
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return err
+	}
+	cert, err := v.certificate(ctx, m)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("unexpected %T signing key", cert.PublicKey)
+	}
+	if rsa.VerifyPKCS1v15(key, hash, digest, signature) != nil {
+		return errBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package snsqs
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+const testCertURL = "https://sns.local/cert.pem"
+
+type testIssuer struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+}
+
+var serial int64
+
+// issue signs a certificate for name with parent, self signed without one.
+func issue(t *testing.T, name string, ca bool, parent *testIssuer) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIssuer{cert: cert, key: key}
+}
+
+func sign(t *testing.T, m *SNSMessage, key *rsa.PrivateKey) {
+	t.Helper()
+	var (
+		hash   crypto.Hash
+		digest []byte
+	)
+	if m.SignatureVersion == "1" {
+		sum := sha1.Sum([]byte(canonical(m)))
+		hash, digest = crypto.SHA1, sum[:]
+	} else {
+		sum := sha256.Sum256([]byte(canonical(m)))
+		hash, digest = crypto.SHA256, sum[:]
+	}
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Signature = base64.StdEncoding.EncodeToString(signature)
+}
+
+func notification(version string) *SNSMessage {
+	timestamp, _ := time.Parse(time.RFC3339, "2023-05-04T10:11:12.345Z")
+	return &SNSMessage{
+		Type:             "Notification",
+		MessageId:        "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+		TopicArn:         "arn:aws:sns:eu-west-1:123456789012:orders",
+		Subject:          "created",
+		Message:          `{"orderId":1}`,
+		Timestamp:        timestamp,
+		SignatureVersion: version,
+		SigningCertURL:   testCertURL,
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	root := issue(t, "root", true, nil)
+	intermediate := issue(t, "intermediate", true, root)
+	leaf := issue(t, "sns.local", false, intermediate)
+	rogue := issue(t, "rogue", true, nil)
+	forged := issue(t, "sns.local", false, rogue)
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+
+	chain := []*x509.Certificate{leaf.cert, intermediate.cert}
+	tests := []struct {
+		name    string
+		version string
+		signer  *rsa.PrivateKey
+		certs   []*x509.Certificate
+		prepare func(*SNSMessage)
+		tamper  func(*SNSMessage)
+		valid   bool
+	}{
+		{name: "v1", version: "1", signer: leaf.key, certs: chain, valid: true},
+		{name: "v2", version: "2", signer: leaf.key, certs: chain, valid: true},
+		{name: "no subject", version: "2", signer: leaf.key, certs: chain, valid: true,
+			prepare: func(m *SNSMessage) { m.Subject = "" }},
+		{name: "missing intermediate", version: "2", signer: leaf.key, certs: chain[:1]},
+		{name: "forged cert", version: "2", signer: forged.key,
+			certs: []*x509.Certificate{forged.cert, rogue.cert}},
+		{name: "wrong key", version: "2", signer: rogue.key, certs: chain},
+		{name: "tampered message", version: "1", signer: leaf.key, certs: chain,
+			tamper: func(m *SNSMessage) { m.Message = `{"orderId":2}` }},
+		{name: "tampered subject", version: "2", signer: leaf.key, certs: chain,
+			tamper: func(m *SNSMessage) { m.Subject = "deleted" }},
+		{name: "tampered topic", version: "2", signer: leaf.key, certs: chain,
+			tamper: func(m *SNSMessage) { m.TopicArn += "-other" }},
+		{name: "tampered timestamp", version: "2", signer: leaf.key, certs: chain,
+			tamper: func(m *SNSMessage) { m.Timestamp = m.Timestamp.Add(time.Millisecond) }},
+		{name: "downgraded version", version: "2", signer: leaf.key, certs: chain,
+			tamper: func(m *SNSMessage) { m.SignatureVersion = "1" }},
+		{name: "unknown version", version: "2", signer: leaf.key, certs: chain,
+			tamper: func(m *SNSMessage) { m.SignatureVersion = "3" }},
+		{name: "untrusted host", version: "2", signer: leaf.key, certs: chain,
+			tamper: func(m *SNSMessage) { m.SigningCertURL = "https://evil.local/cert.pem" }},
+		{name: "plain http", version: "2", signer: leaf.key, certs: chain,
+			tamper: func(m *SNSMessage) { m.SigningCertURL = "http://sns.local/cert.pem" }},
+		{name: "unsigned", version: "2", signer: leaf.key, certs: chain,
+			tamper: func(m *SNSMessage) { m.Signature = "" }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			certs := test.certs
+			v := &Verifier{
+				Roots: roots,
+				Hosts: regexp.MustCompile(`^sns\.local$`),
+				Fetcher: CertificateFetcherFunc(func(_ context.Context, certURL string) ([]*x509.Certificate, error) {
+					return certs, nil
+				}),
+			}
+			m := notification(test.version)
+			if test.prepare != nil {
+				test.prepare(m)
+			}
+			sign(t, m, test.signer)
+			if test.tamper != nil {
+				test.tamper(m)
+			}
+			if err := v.Verify(context.Background(), m); test.valid && err != nil {
+				t.Fatalf("expected valid, got %v", err)
+			} else if !test.valid && err == nil {
+				t.Fatal("expected it to be rejected")
+			}
+		})
+	}
+}
+
+func TestVerifierWithoutRootsTrustsHost(t *testing.T) {
+	leaf := issue(t, "sns.local", false, nil)
+	v := &Verifier{
+		Hosts: regexp.MustCompile(`^sns\.local$`),
+		Fetcher: CertificateFetcherFunc(func(context.Context, string) ([]*x509.Certificate, error) {
+			return []*x509.Certificate{leaf.cert}, nil
+		}),
+	}
+	m := notification("2")
+	sign(t, m, leaf.key)
+	if err := v.Verify(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	m.Message = "tampered"
+	if err := v.Verify(context.Background(), m); err == nil {
+		t.Fatal("expected tampered message to be rejected")
+	}
+}
+
+func TestHTTPCertificateFetcherReadsChain(t *testing.T) {
+	root := issue(t, "root", true, nil)
+	intermediate := issue(t, "intermediate", true, root)
+	leaf := issue(t, "sns.local", false, intermediate)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		for _, cert := range []*x509.Certificate{leaf.cert, intermediate.cert} {
+			_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		}
+	}))
+	defer server.Close()
+
+	fetches := 0
+	fetcher := &HTTPCertificateFetcher{Client: server.Client()}
+	cached := CachedCertificates(CertificateFetcherFunc(
+		func(ctx context.Context, certURL string) ([]*x509.Certificate, error) {
+			fetches++
+			return fetcher.Fetch(ctx, certURL)
+		}))
+	for i := 0; i < 2; i++ {
+		certs, err := cached.Fetch(context.Background(), server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(certs) != 2 || !certs[0].Equal(leaf.cert) || !certs[1].Equal(intermediate.cert) {
+			t.Fatalf("unexpected chain %v", certs)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("expected one fetch, got %d", fetches)
+	}
+}
+
+func TestVerifierSignsTimestampAsReceived(t *testing.T) {
+	leaf := issue(t, "sns.local", false, nil)
+	v := &Verifier{
+		Hosts: regexp.MustCompile(`^sns\.local$`),
+		Fetcher: CertificateFetcherFunc(func(context.Context, string) ([]*x509.Certificate, error) {
+			return []*x509.Certificate{leaf.cert}, nil
+		}),
+	}
+	for _, timestamp := range []string{"2023-05-04T10:11:12.345Z", "2023-05-04T10:11:12.345678Z", "2023-05-04T10:11:12Z"} {
+		t.Run(timestamp, func(t *testing.T) {
+			/*
+				signed over the string as SNS wrote it, then sent through JSON
+			*/
+			signed := notification("2")
+			signed.signedTimestamp = timestamp
+			sign(t, signed, leaf.key)
+			body, err := json.Marshal(map[string]string{
+				"Type": signed.Type, "MessageId": signed.MessageId, "TopicArn": signed.TopicArn,
+				"Subject": signed.Subject, "Message": signed.Message, "Timestamp": timestamp,
+				"SignatureVersion": signed.SignatureVersion, "Signature": signed.Signature,
+				"SigningCertURL": signed.SigningCertURL,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var m SNSMessage
+			if err := json.Unmarshal(body, &m); err != nil {
+				t.Fatal(err)
+			}
+			if expected, _ := time.Parse(time.RFC3339Nano, timestamp); !m.Timestamp.Equal(expected) {
+				t.Fatalf("expected Timestamp %s, got %s", expected, m.Timestamp)
+			}
+			if err := v.Verify(context.Background(), &m); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
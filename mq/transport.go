@@ -0,0 +1,50 @@
+package mq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Transport hides which broker is behind Publisher and Consumer, a
+// destination is an exchange or a topic arn, a source a queue name or url.
+type Transport interface {
+	RunPublisher(ctx context.Context, destination string, published OnPublished,
+		logger logrus.FieldLogger) Publisher
+	RunConsumer(ctx context.Context, source string, handler Handler,
+		logger logrus.FieldLogger) Consumer
+}
+
+var (
+	transportsMu sync.RWMutex
+	transports   = make(map[string]func() Transport)
+)
+
+// Register makes a transport available to Open by name, transports register
+// themselves on import.
+func Register(name string, factory func() Transport) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	transports[name] = factory
+}
+
+// Open builds the transport registered as name, settings (usually a piece
+// of a yaml config) are decoded into it.
+func Open(name string, settings interface{}) (Transport, error) {
+	transportsMu.RLock()
+	factory, ok := transports[name]
+	transportsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %s, forgot to import it ?", name)
+	}
+	t := factory()
+	if raw, err := yaml.Marshal(settings); err != nil {
+		return nil, err
+	} else if err := yaml.Unmarshal(raw, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}